@@ -12,8 +12,20 @@ var (
 	planPath  = flag.String("plan", "", "Path to the plan file, must be formatted as JSON")
 	redisAddr = flag.String("redis", "127.0.0.1:6379", "Address of the target Redis server, to proxy requests to")
 	listen      = flag.String("listen", "127.0.0.1:6380", "Address for the proxy to listen on")
-	// apiAddr   = flag.String("api", "127.0.0.1:8081", "Address for the HTTP API to listen on")
+	apiAddr   = flag.String("api", "127.0.0.1:8081", "Address for the HTTP API to listen on, leave empty to disable the API")
 	logging   = flag.String("log", "", "Log level (give 'v' for verbose logging, 'vv' for very verbose)")
+	cluster   = flag.Bool("cluster", false, "Proxy a Redis Cluster, using the redis address as a seed node")
+	sentinel  = flag.Bool("sentinel", false, "Proxy a Redis Sentinel, the redis address being the sentinel")
+	announce  = flag.String("announce", "", "Host given to clients in rewritten cluster and sentinel replies, defaults to the listen host")
+
+	tlsCert     = flag.String("tls-cert", "", "Path to the certificate for TLS on the proxy listeners, enables TLS with -tls-key")
+	tlsKey      = flag.String("tls-key", "", "Path to the private key for TLS on the proxy listeners")
+	tlsClientCA = flag.String("tls-client-ca", "", "Path to the CA certificates used to verify client certificates, clients must present one when set")
+
+	redisTLS           = flag.Bool("redis-tls", false, "Connect to Redis over TLS")
+	redisTLSCA         = flag.String("redis-tls-ca", "", "Path to the CA certificates used to verify Redis, defaults to the system CAs")
+	redisTLSServerName = flag.String("redis-tls-sni", "", "Server name used for SNI and verification, defaults to the host of the Redis address")
+	redisTLSSkipVerify = flag.Bool("redis-tls-skip-verify", false, "Skip verification of the Redis certificate, only meant for tests")
 )
 
 func main() {
@@ -23,7 +35,7 @@ func main() {
     *planPath,
     *redisAddr,
     *listen,
-    // *apiAddr,
+    *apiAddr,
     *logging,
   )
 	if err != nil {
@@ -31,17 +43,59 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+		err = proxy.EnableTLS(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *redisTLS || len(*redisTLSCA) > 0 || len(*redisTLSServerName) > 0 || *redisTLSSkipVerify {
+		err = proxy.EnableRedisTLS(*redisTLSCA, *redisTLSServerName, *redisTLSSkipVerify)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *cluster && *sentinel {
+		fmt.Println("cluster and sentinel modes can't be combined")
+		os.Exit(1)
+	}
+
+	if *cluster {
+		err = proxy.EnableCluster(*announce)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *sentinel {
+		err = proxy.EnableSentinel(*announce)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	logger := redfi.MakeLogger(len(*logging))
 
 	logger(0, fmt.Sprintf(
     "Loaded %d rules from plan file\n",
-    len(proxy.Plan().RequestRules)+len(proxy.Plan().ResponseRules),
+    proxy.Plan().RuleCount(),
   ))
 
 	// logger(0, fmt.Sprintf("Message ordering: %s\n", proxy.Plan().MsgOrdering))
 
-	// go func() {
-	// 	proxy.StartAPI()
-	// }()
+	go proxy.WatchPlan(logger)
+	go proxy.RunPhases(logger)
+
+	if len(*apiAddr) > 0 {
+		go func() {
+			proxy.StartAPI()
+		}()
+	}
 	proxy.Start(logger)
 }
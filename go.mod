@@ -1,5 +1,10 @@
 module github.com/brettmitchelldev/redfi
 
-go 1.12
+go 1.18
 
-require github.com/tidwall/redcon v1.6.2
+require (
+	github.com/tidwall/match v1.1.1
+	github.com/tidwall/redcon v1.6.2
+)
+
+require github.com/tidwall/btree v1.1.0 // indirect
@@ -1,137 +1,319 @@
 package redfi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type API struct {
+	plan *Plan
+}
+
+var ErrMsg = `{"ok": false, "msg": %s}`
+
+func NewAPI(p *Plan) *API {
+	return &API{plan: p}
+}
+
+type Response struct {
+	OK      bool    `json:"ok"`
+	Message string  `json:"msg,omitempty"`
+	Rules   []*Rule `json:"rules,omitempty"`
+
+	Blackholes []*ActiveBlackhole `json:"blackholes,omitempty"`
+	Schedule   *ScheduleState     `json:"schedule,omitempty"`
+	Phase      *PhaseState        `json:"phase,omitempty"`
+	Counters   []RuleCounter      `json:"counters,omitempty"`
+}
+
+// Handler routes the control API:
 //
-// import (
-// 	"encoding/json"
-// 	"log"
-// 	"net/http"
+//	GET    /rules/{kind}         list rules
+//	POST   /rules/{kind}         create a rule
+//	GET    /rules/{kind}/{name}  get a rule
+//	PUT    /rules/{kind}/{name}  update a rule
+//	DELETE /rules/{kind}/{name}  delete a rule
+//	GET    /blackholes           list the connections held by a blackhole
+//	DELETE /blackholes           release every blackhole
+//	DELETE /blackholes/{rule}    release the blackholes of a rule
+//	GET    /schedule             get where the schedule of the rules is at
+//	POST   /schedule             start the schedule of the rules over
+//	GET    /phase                get the current phase of the scenario
+//	POST   /phase                signal the current phase to end
+//	GET    /counters             list how many times each rule matched and was applied
+//	DELETE /counters             reset the counters of every rule
+//	DELETE /counters/{rule}      reset the counters of a rule
 //
-// 	"github.com/go-chi/chi"
-// )
-//
-// type API struct {
-// 	plan *Plan
-// }
-//
-// var ErrMsg = `{"ok": false, "msg": %s}`
-//
-// func NewAPI(p *Plan) *API {
-// 	return &API{plan: p}
-// }
-//
-// type Response struct {
-// 	OK      bool   `json:"ok"`
-// 	Message string `json:"msg,omitempty"`
-// 	Rules   []Rule `json:"rules,omitempty"`
-// }
-//
-// func (a *API) listRules(rw http.ResponseWriter, req *http.Request) {
-// 	resp := Response{}
-//
-// 	rules := a.plan.ListRules()
-// 	resp.OK = true
-// 	resp.Rules = rules
-// 	err := writeResponse(rw, resp, http.StatusOK)
-// 	if err == nil {
-// 		return
-// 	}
-//
-// 	// error encountered while writing the rules
-// 	resp.OK = false
-// 	resp.Rules = []Rule{}
-// 	resp.Message = err.Error()
-//
-// 	err = writeResponse(rw, resp, http.StatusOK)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusInternalServerError)
-// 		log.Println(err)
-// 	}
-//
-// }
-//
-// func (a *API) createRule(rw http.ResponseWriter, req *http.Request) {
-// 	if req.Body == nil {
-// 		http.Error(rw, "Please send a request body", 400)
-// 		return
-// 	}
-//
-// 	r := Rule{}
-// 	err := json.NewDecoder(req.Body).Decode(&r)
-// 	if err != nil {
-// 		http.Error(rw, err.Error(), 400)
-// 		return
-// 	}
-//
-// 	err = a.plan.AddRule(r)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusBadRequest)
-// 		return
-// 	}
-// 	resp := Response{}
-// 	resp.OK = true
-// 	resp.Rules = []Rule{r}
-// 	err = writeResponse(rw, resp, http.StatusOK)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusBadRequest)
-// 		return
-// 	}
-//
-// }
-//
-// func (a *API) getRule(rw http.ResponseWriter, req *http.Request) {
-// 	ruleName := chi.URLParam(req, "ruleName")
-// 	rule, err := a.plan.GetRule(ruleName)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusNotFound)
-// 		return
-// 	}
-//
-// 	resp := Response{}
-// 	resp.OK = true
-// 	resp.Rules = []Rule{rule}
-// 	err = writeResponse(rw, resp, http.StatusOK)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusBadRequest)
-// 		return
-// 	}
-//
-// }
-//
-// func (a *API) deleteRule(rw http.ResponseWriter, req *http.Request) {
-// 	ruleName := chi.URLParam(req, "ruleName")
-// 	err := a.plan.DeleteRule(ruleName)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusNotFound)
-// 		return
-// 	}
-//
-// 	resp := Response{}
-// 	resp.OK = true
-// 	err = writeResponse(rw, resp, http.StatusOK)
-// 	if err != nil {
-// 		writeErr(rw, err.Error(), http.StatusBadRequest)
-// 		return
-// 	}
-// }
-//
-// func writeErr(rw http.ResponseWriter, errMsg string, status int) {
-// 	resp := Response{}
-// 	resp.OK = false
-// 	resp.Message = errMsg
-//
-// 	err := writeResponse(rw, resp, status)
-// 	if err != nil {
-// 		http.Error(rw, err.Error(), 400)
-// 	}
-// }
-//
-// func writeResponse(rw http.ResponseWriter, r Response, status int) error {
-// 	out, err := json.Marshal(r)
-// 	if err != nil {
-// 		return err
-// 	}
-//
-//   rw.Header().Set("Content-Type", "application/json")
-// 	rw.WriteHeader(status)
-// 	_, err = rw.Write(out)
-// 	return err
-// }
+// where kind is one of request, response, push, tls or connection
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules/", a.routeRules)
+	mux.HandleFunc("/blackholes", a.routeBlackholes)
+	mux.HandleFunc("/blackholes/", a.routeBlackholes)
+	mux.HandleFunc("/schedule", a.routeSchedule)
+	mux.HandleFunc("/phase", a.routePhase)
+	mux.HandleFunc("/counters", a.routeCounters)
+	mux.HandleFunc("/counters/", a.routeCounters)
+	return mux
+}
+
+func (a *API) routeRules(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/rules/"), "/")
+	parts := strings.SplitN(path, "/", 2)
+
+	kind := parts[0]
+	if _, err := a.plan.rulesFor(kind); err != nil {
+		writeErr(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		switch req.Method {
+		case http.MethodGet:
+			a.listRules(rw, req, kind)
+		case http.MethodPost:
+			a.createRule(rw, req, kind)
+		default:
+			writeErr(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	ruleName := parts[1]
+	switch req.Method {
+	case http.MethodGet:
+		a.getRule(rw, req, kind, ruleName)
+	case http.MethodPut:
+		a.updateRule(rw, req, kind, ruleName)
+	case http.MethodDelete:
+		a.deleteRule(rw, req, kind, ruleName)
+	default:
+		writeErr(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) routeBlackholes(rw http.ResponseWriter, req *http.Request) {
+	ruleName := strings.Trim(strings.TrimPrefix(req.URL.Path, "/blackholes"), "/")
+
+	resp := Response{OK: true}
+	switch {
+	case req.Method == http.MethodGet && len(ruleName) == 0:
+		resp.Blackholes = a.plan.Blackholes()
+	case req.Method == http.MethodDelete:
+		resp.Blackholes = a.plan.ReleaseBlackholes(ruleName)
+	default:
+		writeErr(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := writeResponse(rw, resp, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (a *API) routeSchedule(rw http.ResponseWriter, req *http.Request) {
+	var state ScheduleState
+	switch req.Method {
+	case http.MethodGet:
+		state = a.plan.ScheduleState()
+	case http.MethodPost:
+		state = a.plan.TriggerSchedule()
+	default:
+		writeErr(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := writeResponse(rw, Response{OK: true, Schedule: &state}, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (a *API) routeCounters(rw http.ResponseWriter, req *http.Request) {
+	ruleName := strings.Trim(strings.TrimPrefix(req.URL.Path, "/counters"), "/")
+
+	resp := Response{OK: true}
+	switch {
+	case req.Method == http.MethodGet && len(ruleName) == 0:
+		resp.Counters = a.plan.Counters()
+	case req.Method == http.MethodDelete:
+		resp.Counters = a.plan.ResetCounters(ruleName)
+		if len(ruleName) > 0 && len(resp.Counters) == 0 {
+			writeErr(rw, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		writeErr(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := writeResponse(rw, resp, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (a *API) routePhase(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		err := a.plan.SignalPhase()
+		if err != nil {
+			writeErr(rw, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		writeErr(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state := a.plan.PhaseState()
+	err := writeResponse(rw, Response{OK: true, Phase: &state}, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func (a *API) listRules(rw http.ResponseWriter, req *http.Request, kind string) {
+	resp := Response{}
+
+	rules, err := a.plan.ListRules(kind)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp.OK = true
+	resp.Rules = rules
+	err = writeResponse(rw, resp, http.StatusOK)
+	if err == nil {
+		return
+	}
+
+	// error encountered while writing the rules
+	resp.OK = false
+	resp.Rules = []*Rule{}
+	resp.Message = err.Error()
+
+	err = writeResponse(rw, resp, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+	}
+}
+
+func decodeRule(rw http.ResponseWriter, req *http.Request) (Rule, bool) {
+	r := Rule{}
+	if req.Body == nil {
+		writeErr(rw, "Please send a request body", http.StatusBadRequest)
+		return r, false
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusBadRequest)
+		return r, false
+	}
+
+	return r, true
+}
+
+func (a *API) createRule(rw http.ResponseWriter, req *http.Request, kind string) {
+	r, ok := decodeRule(rw, req)
+	if !ok {
+		return
+	}
+
+	err := a.plan.AddRule(kind, r)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.getRule(rw, req, kind, r.Name)
+}
+
+func (a *API) updateRule(rw http.ResponseWriter, req *http.Request, kind string, ruleName string) {
+	r, ok := decodeRule(rw, req)
+	if !ok {
+		return
+	}
+
+	err := a.plan.UpdateRule(kind, ruleName, r)
+	if err == ErrNotFound {
+		writeErr(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(r.Name) > 0 {
+		ruleName = r.Name
+	}
+	a.getRule(rw, req, kind, ruleName)
+}
+
+func (a *API) getRule(rw http.ResponseWriter, req *http.Request, kind string, ruleName string) {
+	rule, err := a.plan.GetRule(kind, ruleName)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := Response{}
+	resp.OK = true
+	resp.Rules = []*Rule{rule}
+	err = writeResponse(rw, resp, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func (a *API) deleteRule(rw http.ResponseWriter, req *http.Request, kind string, ruleName string) {
+	err := a.plan.DeleteRule(kind, ruleName)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resp := Response{}
+	resp.OK = true
+	err = writeResponse(rw, resp, http.StatusOK)
+	if err != nil {
+		writeErr(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func writeErr(rw http.ResponseWriter, errMsg string, status int) {
+	resp := Response{}
+	resp.OK = false
+	resp.Message = errMsg
+
+	err := writeResponse(rw, resp, status)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+	}
+}
+
+func writeResponse(rw http.ResponseWriter, r Response, status int) error {
+	out, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, err = rw.Write(out)
+	return err
+}
@@ -0,0 +1,202 @@
+package redfi
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// BothDirections blackholes both the request and the response streams
+const BothDirections = "both"
+
+// how often a client held by a blackhole is checked for a disconnect
+var blackholePollInterval = 100 * time.Millisecond
+
+// Blackhole stops forwarding messages on a connection while keeping it open
+type Blackhole struct {
+	// RequestStream, ResponseStream or BothDirections, the stream of the rule by default
+	Direction string `json:"direction,omitempty"`
+	// holds messages unread instead of discarding them, so TCP buffers fill up,
+	// and forwards them once the blackhole is released
+	StopReading bool `json:"stopReading,omitempty"`
+	// milliseconds until forwarding resumes, by default it resumes once released
+	// through the control API or once the client disconnects
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (b *Blackhole) validate(ruleName string) error {
+	if b.Timeout < 0 {
+		return fmt.Errorf("blackhole in rule '%s' is malformed, timeout can't be negative", ruleName)
+	}
+
+	switch b.Direction {
+	case "", RequestStream, ResponseStream, BothDirections:
+		return nil
+	}
+	return fmt.Errorf("blackhole in rule '%s' is malformed, direction must be '%s', '%s' or '%s'", ruleName, RequestStream, ResponseStream, BothDirections)
+}
+
+// ActiveBlackhole is a blackhole holding a connection
+type ActiveBlackhole struct {
+	Rule        string    `json:"rule"`
+	ClientAddr  string    `json:"clientAddr"`
+	Request     bool      `json:"request"`
+	Response    bool      `json:"response"`
+	StopReading bool      `json:"stopReading"`
+	Since       time.Time `json:"since"`
+
+	released chan struct{}
+	once     sync.Once
+}
+
+// holds reports whether messages to dst, either the client or Redis, are held
+func (b *ActiveBlackhole) holds(s *session, dst net.Conn) bool {
+	if dst == s.upstream {
+		return b.Request
+	}
+	return b.Response
+}
+
+// wait blocks until the blackhole is released or the client disconnects
+func (b *ActiveBlackhole) wait(s *session, p *Plan) {
+	ticker := time.NewTicker(blackholePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.released:
+			return
+		case <-s.done:
+			p.releaseBlackhole(s, b)
+			return
+		case <-ticker.C:
+			// nothing reads from the client while requests are held unread
+			if b.Request && b.StopReading && peerClosed(s.client) {
+				p.releaseBlackhole(s, b)
+				return
+			}
+		}
+	}
+}
+
+// startBlackhole applies the blackhole of a rule to a connection, replacing any previous one
+func (p *Plan) startBlackhole(streamType string, rule *Rule, s *session, logger Logger) {
+	direction := rule.Blackhole.Direction
+	if len(direction) == 0 {
+		direction = ResponseStream
+		if streamType == "REQUEST" {
+			direction = RequestStream
+		}
+	}
+
+	b := &ActiveBlackhole{
+		Rule:        rule.Name,
+		ClientAddr:  s.ClientAddr,
+		Request:     direction == RequestStream || direction == BothDirections,
+		Response:    direction == ResponseStream || direction == BothDirections,
+		StopReading: rule.Blackhole.StopReading,
+		Since:       time.Now(),
+		released:    make(chan struct{}),
+	}
+
+	p.m.Lock()
+	if p.blackholes == nil {
+		p.blackholes = map[*session]*ActiveBlackhole{}
+	}
+	prev := p.blackholes[s]
+	p.blackholes[s] = b
+	p.m.Unlock()
+
+	if prev != nil {
+		prev.once.Do(func() { close(prev.released) })
+	}
+
+	logger(1, fmt.Sprintf("%s :: Blackholing connection: rule = %s, direction = %s, stop reading = %t\n", streamType, rule.Name, direction, b.StopReading))
+	if rule.Blackhole.Timeout > 0 {
+		time.AfterFunc(time.Duration(rule.Blackhole.Timeout)*time.Millisecond, func() {
+			p.releaseBlackhole(s, b)
+		})
+	}
+}
+
+// passBlackhole waits out the blackhole holding messages to dst, if any.
+// It returns false if the message is discarded instead.
+func (p *Plan) passBlackhole(streamType string, s *session, dst net.Conn, logger Logger) bool {
+	for {
+		p.m.RLock()
+		b := p.blackholes[s]
+		p.m.RUnlock()
+
+		if b == nil || !b.holds(s, dst) {
+			return true
+		}
+		if !b.StopReading {
+			logger(2, fmt.Sprintf("%s :: Discarding message to blackholed connection: rule = %s\n", streamType, b.Rule))
+			return false
+		}
+
+		logger(2, fmt.Sprintf("%s :: Holding message to blackholed connection: rule = %s\n", streamType, b.Rule))
+		b.wait(s, p)
+
+		select {
+		case <-s.done:
+			// the client is gone, there's nobody left to deliver to
+			return false
+		default:
+			// a newer blackhole may have replaced this one
+		}
+	}
+}
+
+// releaseBlackhole resumes forwarding on a connection if b still holds it, b being nil for any blackhole
+func (p *Plan) releaseBlackhole(s *session, b *ActiveBlackhole) {
+	p.m.Lock()
+	current := p.blackholes[s]
+	if current == nil || (b != nil && current != b) {
+		p.m.Unlock()
+		return
+	}
+	delete(p.blackholes, s)
+	p.m.Unlock()
+
+	current.once.Do(func() { close(current.released) })
+}
+
+// Blackholes lists the connections currently held by a blackhole
+func (p *Plan) Blackholes() []*ActiveBlackhole {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	out := []*ActiveBlackhole{}
+	for _, b := range p.blackholes {
+		out = append(out, b)
+	}
+	return out
+}
+
+// ReleaseBlackholes resumes forwarding on the connections held by the given rule, or by any rule if ruleName is empty.
+// It returns the released blackholes.
+func (p *Plan) ReleaseBlackholes(ruleName string) []*ActiveBlackhole {
+	p.m.RLock()
+	sessions := []*session{}
+	for s, b := range p.blackholes {
+		if len(ruleName) == 0 || b.Rule == ruleName {
+			sessions = append(sessions, s)
+		}
+	}
+	p.m.RUnlock()
+
+	released := []*ActiveBlackhole{}
+	for _, s := range sessions {
+		p.m.RLock()
+		b := p.blackholes[s]
+		p.m.RUnlock()
+
+		if b != nil && (len(ruleName) == 0 || b.Rule == ruleName) {
+			p.releaseBlackhole(s, b)
+			released = append(released, b)
+		}
+	}
+	return released
+}
@@ -0,0 +1,182 @@
+package redfi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlackholeValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{Blackhole: &Blackhole{}}, expected: true},
+		{rule: Rule{Blackhole: &Blackhole{Direction: BothDirections, StopReading: true, Timeout: 500}}, expected: true},
+		{rule: Rule{Blackhole: &Blackhole{Direction: "sideways"}}, expected: false},
+		{rule: Rule{Blackhole: &Blackhole{Timeout: -1}}, expected: false},
+	}
+
+	for i, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t#%d:\n\texpected valid = %t\n\toutput         = %v", i, c.expected, err))
+		}
+	}
+}
+
+// readReply reads the next reply within the given time, or returns what went wrong
+func readReply(conn net.Conn, r *bufio.Reader, within time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(within))
+	reply, err := readMessage(r)
+	if err != nil {
+		return "", err
+	}
+	return string(reply.Raw), nil
+}
+
+func TestProxyBlackhole(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestRules  []*Rule
+		responseRules []*Rule
+		// replies to "GET a" then "GET b", empty when nothing is received
+		expected []string
+	}{
+		{
+			name:          "response discarded until timeout",
+			responseRules: []*Rule{{Name: "blackhole", RawMatchAll: []string{"a"}, Blackhole: &Blackhole{Timeout: 100}}},
+			expected:      []string{"", "+b\r\n"},
+		},
+		{
+			name:          "response held until timeout",
+			responseRules: []*Rule{{Name: "blackhole", RawMatchAll: []string{"a"}, Blackhole: &Blackhole{StopReading: true, Timeout: 100}}},
+			expected:      []string{"+a\r\n", "+b\r\n"},
+		},
+		{
+			name:         "request discarded until timeout",
+			requestRules: []*Rule{{Name: "blackhole", KeyPattern: "a", Blackhole: &Blackhole{Timeout: 100}}},
+			expected:     []string{"", "+b\r\n"},
+		},
+		{
+			name:         "both directions from a request",
+			requestRules: []*Rule{{Name: "blackhole", KeyPattern: "a", Blackhole: &Blackhole{Direction: BothDirections, StopReading: true, Timeout: 100}}},
+			expected:     []string{"+a\r\n", "+b\r\n"},
+		},
+	}
+
+	for _, c := range cases {
+		_, conn := rulesProxy(t, c.requestRules, c.responseRules)
+		r := bufio.NewReader(conn)
+
+		_, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// nothing makes it through the blackhole
+		output, err := readReply(conn, r, 50*time.Millisecond)
+		if err, ok := err.(net.Error); !ok || !err.Timeout() {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tunexpected read from blackholed connection: %q, %v", c.name, output, err))
+		}
+
+		// the held reply, if any, comes through once the blackhole times out
+		output, _ = readReply(conn, r, 200*time.Millisecond)
+		if output != c.expected[0] {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, c.expected[0], output))
+		}
+
+		_, err = conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err = readReply(conn, r, 200*time.Millisecond)
+		if output != c.expected[1] {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q, %v", c.name, c.expected[1], output, err))
+		}
+	}
+}
+
+func TestProxyBlackholeRelease(t *testing.T) {
+	plan, conn := rulesProxy(t, []*Rule{
+		{Name: "hold", KeyPattern: "a", Blackhole: &Blackhole{StopReading: true}},
+	}, nil)
+	r := bufio.NewReader(conn)
+
+	_, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := readReply(conn, r, 100*time.Millisecond)
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Fatalf("unexpected read from blackholed connection: %q, %v", output, err)
+	}
+
+	blackholes := plan.Blackholes()
+	if len(blackholes) != 1 || blackholes[0].Rule != "hold" || !blackholes[0].Request || blackholes[0].Response {
+		t.Fatalf("unexpected blackholes: %+v", blackholes)
+	}
+
+	released := plan.ReleaseBlackholes("other")
+	if len(released) != 0 {
+		t.Fatalf("released blackholes of another rule: %+v", released)
+	}
+	released = plan.ReleaseBlackholes("hold")
+	if len(released) != 1 {
+		t.Fatalf("unexpected released blackholes: %+v", released)
+	}
+
+	output, err = readReply(conn, r, 200*time.Millisecond)
+	if output != "+a\r\n" {
+		t.Fatalf("held request wasn't forwarded once released: %q, %v", output, err)
+	}
+	if len(plan.Blackholes()) != 0 {
+		t.Fatalf("blackhole wasn't released: %+v", plan.Blackholes())
+	}
+}
+
+func TestProxyBlackholeClientGone(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestRules  []*Rule
+		responseRules []*Rule
+	}{
+		{
+			name:         "request",
+			requestRules: []*Rule{{Name: "hold", KeyPattern: "a", Blackhole: &Blackhole{StopReading: true}}},
+		},
+		{
+			name:          "response",
+			responseRules: []*Rule{{Name: "hold", RawMatchAll: []string{"a"}, Blackhole: &Blackhole{StopReading: true}}},
+		},
+	}
+
+	for _, c := range cases {
+		plan, conn := rulesProxy(t, c.requestRules, c.responseRules)
+
+		_, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for len(plan.Blackholes()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tconnection wasn't blackholed", c.name))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// the proxy doesn't read from the client, or doesn't write to it, yet notices it left
+		conn.Close()
+		for len(plan.Blackholes()) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tblackhole outlived the client: %+v", c.name, plan.Blackholes()))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
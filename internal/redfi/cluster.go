@@ -0,0 +1,350 @@
+package redfi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// number of hash slots in a Redis Cluster
+const clusterSlots = 16384
+
+// cluster keeps one proxied listener per Redis Cluster node,
+// and rewrites topology replies and redirects so clients only ever see those listeners
+type cluster struct {
+	*nodeMap
+}
+
+// EnableCluster makes the proxy front a Redis Cluster, using the redis address as a seed node.
+// Every other node gets its own listener, on the listen host and the ports following the listen port.
+// announceHost is the host given to clients in rewritten replies, it defaults to the listen host.
+func (p *Proxy) EnableCluster(announceHost string) error {
+	nodes, err := newNodeMap(p, announceHost)
+	if err != nil {
+		return err
+	}
+
+	p.cluster = &cluster{nodes}
+	return nil
+}
+
+// discover asks the seed node for the cluster topology and starts a listener for every node
+func (c *cluster) discover(logger Logger) error {
+	conn, err := c.proxy.dial(c.proxy.redisAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("*2\r\n$7\r\nCLUSTER\r\n$5\r\nSLOTS\r\n"))
+	if err != nil {
+		return err
+	}
+
+	reply, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if reply.Type == redcon.Error {
+		return fmt.Errorf("failed to discover the cluster topology: %s", reply.Data)
+	}
+
+	seedHost, _, _ := net.SplitHostPort(c.proxy.redisAddr)
+	c.rewriteSlots(reply, seedHost, logger)
+	return nil
+}
+
+// rewrite replaces node addresses in the given reply with proxied ones.
+// command is the name of the request the reply belongs to.
+func (c *cluster) rewrite(s *session, command string, msg redcon.RESP, logger Logger) redcon.RESP {
+	upstreamHost, _, _ := net.SplitHostPort(s.UpstreamAddr)
+
+	var out []byte
+	switch {
+	case msg.Type == redcon.Error:
+		out = c.rewriteRedirect(msg, upstreamHost, logger)
+	case command == "cluster slots":
+		out = c.rewriteSlots(msg, upstreamHost, logger)
+	case command == "cluster shards":
+		out = c.rewriteShards(msg, upstreamHost, logger)
+	case command == "cluster nodes" || command == "cluster replicas" || command == "cluster slaves":
+		out = c.rewriteNodes(msg, upstreamHost, logger)
+	}
+
+	if out == nil {
+		return msg
+	}
+
+	_, rewritten := ReadNextRESP(out)
+	logger(2, fmt.Sprintf("Rewrote cluster reply: command = %s, reply = \"\n%s\n\"\n", command, clean(string(rewritten.Raw))))
+	return rewritten
+}
+
+// rewriteRedirect rewrites MOVED and ASK errors, such as: -MOVED 3999 127.0.0.1:6381
+func (c *cluster) rewriteRedirect(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	fields := strings.Fields(string(msg.Data))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return nil
+	}
+
+	fields[2] = c.proxyAddr(resolve(fields[2], upstreamHost), logger)
+	return redcon.AppendError(nil, strings.Join(fields, " "))
+}
+
+// rewriteSlots rewrites a CLUSTER SLOTS reply, an array of [start, end, node...]
+// where each node is [ip, port, id, ...]
+func (c *cluster) rewriteSlots(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	if msg.Type != redcon.Array || msg.Data == nil {
+		return nil
+	}
+
+	out := appendAggregate(nil, msg.Type, msg.Count)
+	forEachRESP(msg, func(slots redcon.RESP) bool {
+		if slots.Type != redcon.Array || slots.Data == nil {
+			out = append(out, slots.Raw...)
+			return true
+		}
+
+		out = appendAggregate(out, slots.Type, slots.Count)
+		i := 0
+		forEachRESP(slots, func(node redcon.RESP) bool {
+			if i < 2 || node.Type != redcon.Array || node.Count < 2 {
+				out = append(out, node.Raw...)
+			} else {
+				out = c.rewriteSlotsNode(out, node, upstreamHost, logger)
+			}
+			i++
+			return true
+		})
+		return true
+	})
+
+	return out
+}
+
+func (c *cluster) rewriteSlotsNode(out []byte, node redcon.RESP, upstreamHost string, logger Logger) []byte {
+	fields := []redcon.RESP{}
+	forEachRESP(node, func(field redcon.RESP) bool {
+		fields = append(fields, field)
+		return true
+	})
+
+	addr := c.proxyAddr(resolve(net.JoinHostPort(string(fields[0].Data), string(fields[1].Data)), upstreamHost), logger)
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	out = appendAggregate(out, node.Type, node.Count)
+	out = redcon.AppendBulkString(out, host)
+	out = redcon.AppendInt(out, int64(port))
+	for _, field := range fields[2:] {
+		out = append(out, field.Raw...)
+	}
+	return out
+}
+
+// rewriteShards rewrites a CLUSTER SHARDS reply, an array of shards
+// where each shard is a map holding a list of node maps under "nodes"
+func (c *cluster) rewriteShards(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	if msg.Type != redcon.Array || msg.Data == nil {
+		return nil
+	}
+
+	out := appendAggregate(nil, msg.Type, msg.Count)
+	forEachRESP(msg, func(shard redcon.RESP) bool {
+		out = appendAggregate(out, shard.Type, shard.Count)
+		forEachPair(shard, func(key, val redcon.RESP) bool {
+			out = append(out, key.Raw...)
+			if rlower(key) != "nodes" || val.Data == nil {
+				out = append(out, val.Raw...)
+				return true
+			}
+
+			out = appendAggregate(out, val.Type, val.Count)
+			forEachRESP(val, func(node redcon.RESP) bool {
+				out = c.rewriteShardsNode(out, node, upstreamHost, logger)
+				return true
+			})
+			return true
+		})
+		return true
+	})
+
+	return out
+}
+
+func (c *cluster) rewriteShardsNode(out []byte, node redcon.RESP, upstreamHost string, logger Logger) []byte {
+	ip, endpoint, port, tlsPort := "", "", "", ""
+	forEachPair(node, func(key, val redcon.RESP) bool {
+		switch rlower(key) {
+		case "ip":
+			ip = string(val.Data)
+		case "endpoint":
+			endpoint = string(val.Data)
+		case "port":
+			port = string(val.Data)
+		case "tls-port":
+			tlsPort = string(val.Data)
+		}
+		return true
+	})
+
+	// nodes that only listen for TLS connections have no port, the proxy connects to their TLS port
+	if len(port) == 0 {
+		port = tlsPort
+	}
+	if len(port) == 0 {
+		logger(1, fmt.Sprintf("Skipping node without a port in CLUSTER SHARDS reply: %s\n", clean(string(node.Raw))))
+		return append(out, node.Raw...)
+	}
+	if len(ip) == 0 {
+		ip = endpoint
+	}
+
+	addr := c.proxyAddr(resolve(net.JoinHostPort(ip, port), upstreamHost), logger)
+	proxyHost, proxyPortStr, _ := net.SplitHostPort(addr)
+	proxyPort, _ := strconv.Atoi(proxyPortStr)
+
+	out = appendAggregate(out, node.Type, node.Count)
+	forEachPair(node, func(key, val redcon.RESP) bool {
+		out = append(out, key.Raw...)
+		switch rlower(key) {
+		case "ip", "endpoint":
+			out = redcon.AppendBulkString(out, proxyHost)
+		case "hostname":
+			if len(val.Data) > 0 {
+				out = redcon.AppendBulkString(out, proxyHost)
+			} else {
+				out = append(out, val.Raw...)
+			}
+		case "port", "tls-port":
+			// either port of the node leads to the proxy
+			out = redcon.AppendInt(out, int64(proxyPort))
+		default:
+			out = append(out, val.Raw...)
+		}
+		return true
+	})
+	return out
+}
+
+// rewriteNodes rewrites CLUSTER NODES replies, and the arrays of node lines sent for CLUSTER REPLICAS.
+// Each line looks like: <id> <ip:port@cport[,hostname]> <flags> ...
+func (c *cluster) rewriteNodes(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	switch msg.Type {
+	case redcon.Bulk:
+		if msg.Data == nil {
+			return nil
+		}
+		return redcon.AppendBulkString(nil, c.rewriteNodeLines(string(msg.Data), upstreamHost, logger))
+
+	case Verbatim:
+		// verbatim strings start with their format, e.g. txt:
+		if len(msg.Data) < 4 {
+			return nil
+		}
+		text := string(msg.Data[:4]) + c.rewriteNodeLines(string(msg.Data[4:]), upstreamHost, logger)
+		out := append([]byte{Verbatim}, strconv.Itoa(len(text))...)
+		out = append(out, "\r\n"...)
+		out = append(out, text...)
+		return append(out, "\r\n"...)
+
+	case redcon.Array:
+		if msg.Data == nil {
+			return nil
+		}
+		out := appendAggregate(nil, msg.Type, msg.Count)
+		forEachRESP(msg, func(line redcon.RESP) bool {
+			rewritten := c.rewriteNodes(line, upstreamHost, logger)
+			if rewritten == nil {
+				rewritten = line.Raw
+			}
+			out = append(out, rewritten...)
+			return true
+		})
+		return out
+	}
+
+	return nil
+}
+
+func (c *cluster) rewriteNodeLines(text string, upstreamHost string, logger Logger) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			continue
+		}
+
+		addr, rest := fields[1], ""
+		if at := strings.IndexByte(addr, '@'); at >= 0 {
+			addr, rest = addr[:at], addr[at:]
+		}
+
+		// nodes still in handshake have no address yet
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil || port == "0" {
+			continue
+		}
+
+		fields[1] = c.proxyAddr(resolve(addr, upstreamHost), logger) + rest
+		lines[i] = strings.Join(fields, " ")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// commandName returns the lowercase name of a request,
+// including the subcommand for CLUSTER and SENTINEL requests, e.g. "cluster slots"
+func commandName(msg redcon.RESP) string {
+	args, err := respArrToSlice(msg)
+	if err != nil || len(args) == 0 {
+		return ""
+	}
+
+	name := rlower(args[0])
+	if (name == "cluster" || name == "sentinel") && len(args) > 1 {
+		name += " " + rlower(args[1])
+	}
+	return name
+}
+
+// msgSlot returns the hash slot of the first key of a request
+func msgSlot(msg redcon.RESP) (int, bool) {
+	keys := commandKeys(msg)
+	if len(keys) == 0 {
+		return 0, false
+	}
+
+	return keySlot(keys[0]), true
+}
+
+// keySlot returns the hash slot of a key, honouring {hash tags}
+func keySlot(key []byte) int {
+	if start := strings.IndexByte(string(key), '{'); start >= 0 {
+		if end := strings.IndexByte(string(key[start+1:]), '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum Redis Cluster uses for key hashing
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
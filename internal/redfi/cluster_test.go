@@ -0,0 +1,140 @@
+package redfi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected int
+	}{
+		{key: "foo", expected: 12182},
+		{key: "bar", expected: 5061},
+		{key: "{user1000}.following", expected: 3443},
+		{key: "{user1000}.followers", expected: 3443},
+		{key: "foo{}{bar}", expected: 8363},
+	}
+
+	for _, c := range cases {
+		output := keySlot([]byte(c.key))
+		if output != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %d\n\toutput   = %d", c.key, c.expected, output))
+		}
+	}
+}
+
+func TestClusterRewrite(t *testing.T) {
+	c := &cluster{&nodeMap{
+		announceHost: "proxy",
+		nodes: map[string]string{
+			"10.0.0.1:7000": "proxy:6380",
+			"10.0.0.2:7001": "proxy:6381",
+			"10.0.0.3:7002": "proxy:6382",
+		},
+	}}
+	s := &session{ConnInfo: ConnInfo{UpstreamAddr: "10.0.0.1:7000"}}
+
+	cases := []struct {
+		name     string
+		command  string
+		reply    string
+		expected string
+	}{
+		{
+			name:     "moved redirect",
+			command:  "get",
+			reply:    "-MOVED 3999 10.0.0.2:7001\r\n",
+			expected: "-MOVED 3999 proxy:6381\r\n",
+		},
+		{
+			name:     "ask redirect without a host",
+			command:  "get",
+			reply:    "-ASK 3999 :7000\r\n",
+			expected: "-ASK 3999 proxy:6380\r\n",
+		},
+		{
+			name:     "other errors are untouched",
+			command:  "get",
+			reply:    "-ERR unknown command\r\n",
+			expected: "-ERR unknown command\r\n",
+		},
+		{
+			name:     "cluster slots",
+			command:  "cluster slots",
+			reply:    "*1\r\n*4\r\n:0\r\n:5460\r\n*3\r\n$8\r\n10.0.0.1\r\n:7000\r\n$2\r\nid\r\n*2\r\n$8\r\n10.0.0.2\r\n:7001\r\n",
+			expected: "*1\r\n*4\r\n:0\r\n:5460\r\n*3\r\n$5\r\nproxy\r\n:6380\r\n$2\r\nid\r\n*2\r\n$5\r\nproxy\r\n:6381\r\n",
+		},
+		{
+			name:     "cluster shards",
+			command:  "cluster shards",
+			reply:    "*1\r\n%2\r\n$5\r\nslots\r\n*0\r\n$5\r\nnodes\r\n*1\r\n%3\r\n$2\r\nip\r\n$8\r\n10.0.0.2\r\n$4\r\nport\r\n:7001\r\n$8\r\nhostname\r\n$0\r\n\r\n",
+			expected: "*1\r\n%2\r\n$5\r\nslots\r\n*0\r\n$5\r\nnodes\r\n*1\r\n%3\r\n$2\r\nip\r\n$5\r\nproxy\r\n$4\r\nport\r\n:6381\r\n$8\r\nhostname\r\n$0\r\n\r\n",
+		},
+		{
+			name:     "cluster shards with a TLS only node",
+			command:  "cluster shards",
+			reply:    "*1\r\n%2\r\n$5\r\nslots\r\n*0\r\n$5\r\nnodes\r\n*1\r\n%2\r\n$2\r\nip\r\n$8\r\n10.0.0.3\r\n$8\r\ntls-port\r\n:7002\r\n",
+			expected: "*1\r\n%2\r\n$5\r\nslots\r\n*0\r\n$5\r\nnodes\r\n*1\r\n%2\r\n$2\r\nip\r\n$5\r\nproxy\r\n$8\r\ntls-port\r\n:6382\r\n",
+		},
+		{
+			name:     "cluster shards with both ports",
+			command:  "cluster shards",
+			reply:    "*1\r\n%2\r\n$5\r\nslots\r\n*0\r\n$5\r\nnodes\r\n*1\r\n%3\r\n$2\r\nip\r\n$8\r\n10.0.0.2\r\n$4\r\nport\r\n:7001\r\n$8\r\ntls-port\r\n:8001\r\n",
+			expected: "*1\r\n%2\r\n$5\r\nslots\r\n*0\r\n$5\r\nnodes\r\n*1\r\n%3\r\n$2\r\nip\r\n$5\r\nproxy\r\n$4\r\nport\r\n:6381\r\n$8\r\ntls-port\r\n:6381\r\n",
+		},
+		{
+			name:     "cluster nodes",
+			command:  "cluster nodes",
+			reply:    "$45\r\nabc 10.0.0.2:7001@17001 master - 0 0 1 0-5460\r\n",
+			expected: "$42\r\nabc proxy:6381@17001 master - 0 0 1 0-5460\r\n",
+		},
+		{
+			name:     "replies to other commands are untouched",
+			command:  "lrange",
+			reply:    "*2\r\n$8\r\n10.0.0.1\r\n:7000\r\n",
+			expected: "*2\r\n$8\r\n10.0.0.1\r\n:7000\r\n",
+		},
+	}
+
+	for _, cs := range cases {
+		output := c.rewrite(s, cs.command, Resp3([]byte(cs.reply)), MakeLogger(-1))
+		if string(output.Raw) != cs.expected {
+			t.Fatal(fmt.Sprintf(
+				"Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q",
+				cs.name,
+				cs.expected,
+				output.Raw,
+			))
+		}
+	}
+}
+
+func TestSelectRuleShardAndSlots(t *testing.T) {
+	p := &Plan{
+		RequestRules: []*Rule{
+			{Name: "shard", Shard: "10.0.0.2"},
+			{Name: "slots", Slots: [][2]int{{0, 5460}}},
+		},
+	}
+	conn := &ConnInfo{ClientAddr: "127.0.0.1:50000", UpstreamAddr: "10.0.0.1:7000"}
+
+	// "bar" hashes to slot 5061
+	rule := p.SelectRule("REQUEST", p.RequestRules, conn, Resp([]byte("*2\r\n$3\r\nGET\r\n$3\r\nbar\r\n")), MakeLogger(-1))
+	if rule == nil || rule.Name != "slots" {
+		t.Fatal(fmt.Sprintf("expected the slots rule to match, got %v", rule))
+	}
+
+	// "foo" hashes to slot 12182
+	rule = p.SelectRule("REQUEST", p.RequestRules, conn, Resp([]byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")), MakeLogger(-1))
+	if rule != nil {
+		t.Fatal(fmt.Sprintf("expected no rule to match, got %v", rule))
+	}
+
+	conn.UpstreamAddr = "10.0.0.2:7001"
+	rule = p.SelectRule("REQUEST", p.RequestRules, conn, Resp([]byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")), MakeLogger(-1))
+	if rule == nil || rule.Name != "shard" {
+		t.Fatal(fmt.Sprintf("expected the shard rule to match, got %v", rule))
+	}
+}
@@ -0,0 +1,86 @@
+package redfi
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// DialFail fails to connect to Redis, the client connection is then closed as when Redis is down
+type DialFail struct {
+	// milliseconds the dial hangs before failing, as when Redis is unreachable,
+	// by default it fails right away as when Redis refuses the connection
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func (d *DialFail) validate(ruleName string) error {
+	if d.Timeout < 0 {
+		return fmt.Errorf("dialFail in rule '%s' is malformed, timeout can't be negative", ruleName)
+	}
+	return nil
+}
+
+// admit applies the first matching connection rule to a new client, before anything is read from it.
+// It returns the rule, and false if the connection was turned away.
+func (p *Proxy) admit(conn net.Conn, info *ConnInfo, logger Logger) (*Rule, bool) {
+	rule := p.plan.SelectRule("CONNECTION", p.plan.Rules(ConnectionStream), info, redcon.RESP{}, logger)
+	if rule == nil {
+		return nil, true
+	}
+
+	if rule.Delay > 0 || rule.Latency != nil {
+		delay := p.plan.delayFor(rule)
+		logger(1, fmt.Sprintf("CONNECTION :: Delaying connection: rule = %s, delay = %s\n", rule.Name, delay))
+		time.Sleep(delay)
+	}
+
+	if rule.disconnects() {
+		// there's no connection to Redis yet, and nothing to half-close
+		mode := FinDisconnect
+		if rule.Disconnect != nil && rule.Disconnect.Mode == RstDisconnect {
+			mode = RstDisconnect
+		}
+		logger(1, fmt.Sprintf("CONNECTION :: Refusing connection: rule = %s, mode = %s\n", rule.Name, mode))
+
+		err := (&Disconnect{Mode: mode}).apply(conn)
+		if err != nil {
+			log.Println("encountered error while refusing connection, closing it instead:", err)
+			conn.Close()
+		}
+		return rule, false
+	}
+
+	return rule, true
+}
+
+// turnAway answers a new client with the reply of a connection rule, such as the error Redis sends
+// once maxclients is reached, then closes the connection
+func (p *Proxy) turnAway(conn net.Conn, rule *Rule, logger Logger) {
+	reply := rule.syntheticReply(redcon.RESP{})
+	logger(1, fmt.Sprintf("CONNECTION :: Turning connection away: rule = %s, reply = '%s'\n", rule.Name, clean(string(reply))))
+
+	_, err := conn.Write(reply)
+	if err != nil {
+		log.Println(err)
+	}
+	conn.Close()
+}
+
+// dialUpstream connects to Redis, unless the connection rule fails the dial
+func (p *Proxy) dialUpstream(rule *Rule, addr string, logger Logger) (net.Conn, error) {
+	if rule == nil || rule.DialFail == nil {
+		return p.dial(addr)
+	}
+
+	if rule.DialFail.Timeout > 0 {
+		logger(1, fmt.Sprintf("CONNECTION :: Timing out dial to %s: rule = %s, timeout = %dms\n", addr, rule.Name, rule.DialFail.Timeout))
+		time.Sleep(time.Duration(rule.DialFail.Timeout) * time.Millisecond)
+		return nil, fmt.Errorf("dial to %s timed out by rule '%s'", addr, rule.Name)
+	}
+
+	logger(1, fmt.Sprintf("CONNECTION :: Failing dial to %s: rule = %s\n", addr, rule.Name))
+	return nil, fmt.Errorf("dial to %s refused by rule '%s'", addr, rule.Name)
+}
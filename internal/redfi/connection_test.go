@@ -0,0 +1,155 @@
+package redfi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialFailValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{DialFail: &DialFail{}}, expected: true},
+		{rule: Rule{DialFail: &DialFail{Timeout: 500}}, expected: true},
+		{rule: Rule{DialFail: &DialFail{Timeout: -1}}, expected: false},
+	}
+
+	for i, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t#%d:\n\texpected valid = %t\n\toutput         = %v", i, c.expected, err))
+		}
+	}
+}
+
+func TestProxyConnectionRules(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []*Rule
+		// what the client reads, after sending "GET a" if the connection stays open, and how the connection ends
+		expected string
+		err      error
+		// minimum time until the connection ends, or the client is answered if it stays open
+		after time.Duration
+	}{
+		{
+			name:     "no rule",
+			expected: "+a\r\n",
+		},
+		{
+			name:  "closed after accept",
+			rules: []*Rule{{Name: "close", AlwaysMatch: true, Drop: true}},
+			err:   io.EOF,
+		},
+		{
+			name:  "refused",
+			rules: []*Rule{{Name: "refuse", AlwaysMatch: true, Disconnect: &Disconnect{Mode: RstDisconnect}}},
+			err:   syscall.ECONNRESET,
+		},
+		{
+			name:     "max clients",
+			rules:    []*Rule{{Name: "maxclients", AlwaysMatch: true, ReturnErr: "ERR max number of clients reached"}},
+			expected: "-ERR max number of clients reached\r\n",
+			err:      io.EOF,
+		},
+		{
+			name:     "delayed accept",
+			rules:    []*Rule{{Name: "slow_accept", AlwaysMatch: true, Delay: 100}},
+			expected: "+a\r\n",
+			after:    100 * time.Millisecond,
+		},
+		{
+			name:  "upstream refused",
+			rules: []*Rule{{Name: "redis_down", AlwaysMatch: true, DialFail: &DialFail{}}},
+			err:   io.EOF,
+		},
+		{
+			name:  "upstream timeout",
+			rules: []*Rule{{Name: "redis_unreachable", AlwaysMatch: true, DialFail: &DialFail{Timeout: 100}}},
+			err:   io.EOF,
+			after: 100 * time.Millisecond,
+		},
+		{
+			name:     "other client address",
+			rules:    []*Rule{{Name: "remote", ClientAddr: "10.", Drop: true}},
+			expected: "+a\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		_, addr := startProxy(t, "127.0.0.1:0", func(plan *Plan) {
+			plan.ConnectionRules = c.rules
+		})
+
+		conn, err := net.Dial("tcp", addr)
+		if errors.Is(err, syscall.ECONNRESET) && c.err == syscall.ECONNRESET {
+			// reset before the dial even returned
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		start := time.Now()
+		if c.err == nil {
+			// closing a connection with unread data resets it, only send to connections that stay open
+			conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		}
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, _ := io.ReadAtLeast(conn, buf, len(c.expected))
+		elapsed := time.Since(start)
+		if string(buf[:n]) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, c.expected, buf[:n]))
+		}
+
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = conn.Read(buf)
+		if c.err != nil {
+			elapsed = time.Since(start)
+		}
+		if c.err == nil {
+			if err, ok := err.(net.Error); !ok || !err.Timeout() {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected the connection to stay open\n\toutput   = %v", c.name, err))
+			}
+		} else if !errors.Is(err, c.err) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %v\n\toutput   = %v", c.name, c.err, err))
+		}
+
+		if elapsed < c.after {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected after %s\n\toutput   after %s", c.name, c.after, elapsed))
+		}
+	}
+
+	// the ordinal only matches the first connection
+	_, addr := startProxy(t, "127.0.0.1:0", func(plan *Plan) {
+		next := float64(atomic.LoadUint64(&lastConnID) + 1)
+		plan.ConnectionRules = []*Rule{{Name: "first_only", ConnectionID: &NumberMatcher{Eq: &next}, Drop: true}}
+	})
+	for i, expected := range []string{"", "+a\r\n"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if i > 0 {
+			conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, _ := io.ReadAtLeast(conn, buf, 1)
+		if string(buf[:n]) != expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\tconnection #%d:\n\texpected = %q\n\toutput   = %q", i+1, expected, buf[:n]))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package redfi
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// BitFlipCorruption flips random bits of the value
+	BitFlipCorruption = "bitflip"
+	// SubstituteCorruption replaces random bytes of the value
+	SubstituteCorruption = "substitute"
+	// TruncateCorruption shortens the value
+	TruncateCorruption = "truncate"
+	// SwapCorruption exchanges the value with another one of the reply, or with the given value
+	SwapCorruption = "swap"
+)
+
+// Corrupt mutates the bulk strings of a reply, nested ones included, while keeping it valid RESP
+type Corrupt struct {
+	Mode string `json:"mode"`
+	// bits flipped or bytes substituted in each value, 1 by default
+	Count int `json:"count,omitempty"`
+	// bytes kept by truncate, half of the value by default
+	Length *int `json:"length,omitempty"`
+	// swaps values with this one instead of another value of the reply
+	Value *string `json:"value,omitempty"`
+	// corrupts every bulk string of the reply instead of a random one
+	All bool `json:"all,omitempty"`
+}
+
+func (c *Corrupt) validate(ruleName string) error {
+	switch c.Mode {
+	case BitFlipCorruption, SubstituteCorruption, TruncateCorruption, SwapCorruption:
+	default:
+		return fmt.Errorf("corrupt in rule '%s' is malformed, unknown mode '%s'", ruleName, c.Mode)
+	}
+
+	if c.Count < 0 || (c.Length != nil && *c.Length < 0) {
+		return fmt.Errorf("corrupt in rule '%s' is malformed, count and length can't be negative", ruleName)
+	}
+	return nil
+}
+
+// bulkSpan locates a bulk string in a message
+type bulkSpan struct {
+	// offset of the header, e.g. "$5\r\n"
+	header int
+	// offsets of the value
+	start, end int
+}
+
+// bulkSpans returns the bulk strings of the message starting at b[off:], nested ones included,
+// along with the offset of the end of the message.
+// Map keys and attributes aren't included, and the format prefix of verbatim strings is left out of their value.
+func bulkSpans(b []byte, off int, spans []bulkSpan) (int, []bulkSpan) {
+	n, _ := ReadNextRESP(b[off:])
+	if n == 0 {
+		return len(b), spans
+	}
+	end := off + n
+
+	eol := bytes.IndexByte(b[off:], '\n') + off
+	count, err := strconv.Atoi(string(b[off+1 : eol-1]))
+	if err != nil || count < 0 {
+		return end, spans
+	}
+
+	switch b[off] {
+	case redcon.Bulk:
+		spans = append(spans, bulkSpan{header: off, start: eol + 1, end: eol + 1 + count})
+
+	case Verbatim:
+		// the value is prefixed by its format, e.g. "txt:"
+		if count >= 4 {
+			spans = append(spans, bulkSpan{header: off, start: eol + 5, end: eol + 1 + count})
+		}
+
+	case redcon.Array, Set, Push:
+		pos := eol + 1
+		for i := 0; i < count; i++ {
+			pos, spans = bulkSpans(b, pos, spans)
+		}
+
+	case Map:
+		pos := eol + 1
+		for i := 0; i < count; i++ {
+			kn, _ := ReadNextRESP(b[pos:])
+			pos, spans = bulkSpans(b, pos+kn, spans)
+		}
+
+	case Attribute:
+		// skip the attribute, then look into the reply it annotates
+		pos := eol + 1
+		for i := 0; i < count*2; i++ {
+			kn, _ := ReadNextRESP(b[pos:])
+			pos += kn
+		}
+		_, spans = bulkSpans(b, pos, spans)
+	}
+
+	return end, spans
+}
+
+// apply returns a corrupted copy of a message, or the message itself if it holds no value to corrupt
+func (c *Corrupt) apply(raw []byte, r *rand.Rand) []byte {
+	_, spans := bulkSpans(raw, 0, nil)
+	if len(spans) == 0 {
+		return raw
+	}
+
+	values := make([][]byte, len(spans))
+	for i, span := range spans {
+		values[i] = append([]byte{}, raw[span.start:span.end]...)
+	}
+
+	targets := []int{r.Intn(len(spans))}
+	if c.All {
+		targets = r.Perm(len(spans))
+	}
+
+	count := c.Count
+	if count == 0 {
+		count = 1
+	}
+
+	for _, i := range targets {
+		value := values[i]
+		switch c.Mode {
+		case BitFlipCorruption:
+			for j := 0; j < count && len(value) > 0; j++ {
+				bit := r.Intn(len(value) * 8)
+				value[bit/8] ^= 1 << uint(bit%8)
+			}
+
+		case SubstituteCorruption:
+			for j := 0; j < count && len(value) > 0; j++ {
+				pos := r.Intn(len(value))
+				// never substitute a byte for itself
+				value[pos] ^= byte(1 + r.Intn(255))
+			}
+
+		case TruncateCorruption:
+			length := len(value) / 2
+			if c.Length != nil && *c.Length < len(value) {
+				length = *c.Length
+			}
+			value = value[:length]
+
+		case SwapCorruption:
+			if c.Value != nil {
+				value = []byte(*c.Value)
+			} else if len(spans) > 1 {
+				// exchange with any other value of the reply
+				other := (i + 1 + r.Intn(len(spans)-1)) % len(spans)
+				values[i], values[other] = values[other], values[i]
+				continue
+			}
+		}
+		values[i] = value
+	}
+
+	// splice the values back in, rewriting the length in their header
+	out := make([]byte, 0, len(raw))
+	last := 0
+	for i, span := range spans {
+		eol := bytes.IndexByte(raw[span.header:], '\n') + span.header
+		prefix := raw[eol+1 : span.start]
+
+		out = append(out, raw[last:span.header]...)
+		out = append(out, raw[span.header])
+		out = strconv.AppendInt(out, int64(len(prefix)+len(values[i])), 10)
+		out = append(out, '\r', '\n')
+		out = append(out, prefix...)
+		out = append(out, values[i]...)
+		last = span.end
+	}
+	return append(out, raw[last:]...)
+}
@@ -0,0 +1,114 @@
+package redfi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCorruptApply(t *testing.T) {
+	length := func(n int) *int { return &n }
+	value := func(s string) *string { return &s }
+
+	cases := []struct {
+		name    string
+		corrupt Corrupt
+		input   string
+		// exact output, or the number of bytes expected to differ when empty
+		expected string
+		diff     int
+	}{
+		{name: "bit flip", corrupt: Corrupt{Mode: BitFlipCorruption}, input: "$5\r\nhello\r\n", diff: 1},
+		{name: "substitution", corrupt: Corrupt{Mode: SubstituteCorruption}, input: "$5\r\nhello\r\n", diff: 1},
+		{
+			name:     "truncate to half by default",
+			corrupt:  Corrupt{Mode: TruncateCorruption},
+			input:    "$6\r\nfoobar\r\n",
+			expected: "$3\r\nfoo\r\n",
+		},
+		{
+			name:     "truncate every value of an array",
+			corrupt:  Corrupt{Mode: TruncateCorruption, Length: length(1), All: true},
+			input:    "*2\r\n$3\r\nabc\r\n$2\r\nde\r\n",
+			expected: "*2\r\n$1\r\na\r\n$1\r\nd\r\n",
+		},
+		{
+			name:     "swap with another value",
+			corrupt:  Corrupt{Mode: SwapCorruption},
+			input:    "*2\r\n$3\r\nabc\r\n$2\r\nde\r\n",
+			expected: "*2\r\n$2\r\nde\r\n$3\r\nabc\r\n",
+		},
+		{
+			name:     "swap with a value in nested aggregates, map keys are left alone",
+			corrupt:  Corrupt{Mode: SwapCorruption, Value: value("xyz"), All: true},
+			input:    "*2\r\n*1\r\n$1\r\na\r\n%1\r\n$1\r\nk\r\n$1\r\nv\r\n",
+			expected: "*2\r\n*1\r\n$3\r\nxyz\r\n%1\r\n$1\r\nk\r\n$3\r\nxyz\r\n",
+		},
+		{
+			name:     "verbatim strings keep their format",
+			corrupt:  Corrupt{Mode: TruncateCorruption, Length: length(2)},
+			input:    "=9\r\ntxt:hello\r\n",
+			expected: "=6\r\ntxt:he\r\n",
+		},
+		{
+			name:     "attributes are kept",
+			corrupt:  Corrupt{Mode: TruncateCorruption},
+			input:    "|1\r\n+ttl\r\n:3\r\n$4\r\nabcd\r\n",
+			expected: "|1\r\n+ttl\r\n:3\r\n$2\r\nab\r\n",
+		},
+		{name: "no bulk string", corrupt: Corrupt{Mode: BitFlipCorruption}, input: "+OK\r\n", expected: "+OK\r\n"},
+		{name: "null bulk string", corrupt: Corrupt{Mode: SwapCorruption, Value: value("a")}, input: "$-1\r\n", expected: "$-1\r\n"},
+	}
+
+	for _, c := range cases {
+		output := string(c.corrupt.apply([]byte(c.input), newRandom(1)))
+
+		n, _ := ReadNextRESP([]byte(output))
+		if n != len(output) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tinvalid RESP = %q", c.name, output))
+		}
+
+		if len(c.expected) > 0 {
+			if output != c.expected {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, c.expected, output))
+			}
+			continue
+		}
+
+		diff := 0
+		for i := range output {
+			if output[i] != c.input[i] {
+				diff++
+			}
+		}
+		if len(output) != len(c.input) || diff != c.diff {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %d byte(s) changed in %q\n\toutput   = %q", c.name, c.diff, c.input, output))
+		}
+	}
+}
+
+func TestCorruptValidateKind(t *testing.T) {
+	cases := []struct {
+		kind     string
+		expected bool
+	}{
+		{kind: ResponseStream, expected: true},
+		{kind: PushStream, expected: true},
+		{kind: RequestStream, expected: false},
+		{kind: TLSStream, expected: false},
+		{kind: ConnectionStream, expected: false},
+	}
+
+	for _, c := range cases {
+		p := NewPlan()
+		err := p.AddRule(c.kind, Rule{Name: "corrupt", AlwaysMatch: true, Corrupt: &Corrupt{Mode: BitFlipCorruption}})
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s rule:\n\texpected valid = %t\n\toutput         = %v", c.kind, c.expected, err))
+		}
+	}
+
+	// request rules are also checked when the plan is parsed
+	_, err := parsePlan(t, `{"requestRules": [{"name": "corrupt", "alwaysMatch": true, "corrupt": {"mode": "bitflip"}}]}`)
+	if err == nil {
+		t.Fatal("expected an error for corrupt on a request rule")
+	}
+}
@@ -0,0 +1,101 @@
+package redfi
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// RuleCounter holds how many times a rule matched, and how many times it was applied
+type RuleCounter struct {
+	Kind    string `json:"kind"`
+	Rule    string `json:"rule"`
+	Matches uint64 `json:"matches"`
+	Hits    uint64 `json:"hits"`
+}
+
+func validateHitLimits(r *Rule) error {
+	if r.MaxHits < 0 || r.SkipFirst < 0 || r.EveryNth < 0 {
+		return fmt.Errorf("rule '%s' is malformed, maxHits, skipFirst and everyNth can't be negative", r.Name)
+	}
+	return nil
+}
+
+// exhausted reports whether a rule was applied as many times as it may be
+func (r *Rule) exhausted() bool {
+	return r.MaxHits > 0 && atomic.LoadUint64(&r.hits) >= uint64(r.MaxHits)
+}
+
+// countsMatch reports whether the nth match of a rule is one it applies to, as set by skipFirst and everyNth
+func (r *Rule) countsMatch(n uint64) bool {
+	if n <= uint64(r.SkipFirst) {
+		return false
+	}
+	return r.EveryNth <= 1 || (n-uint64(r.SkipFirst))%uint64(r.EveryNth) == 0
+}
+
+// hit counts an application of a rule, it returns false if the rule may not be applied anymore
+func (r *Rule) hit() (uint64, bool) {
+	if r.MaxHits == 0 {
+		return atomic.AddUint64(&r.hits, 1), true
+	}
+
+	for {
+		hits := atomic.LoadUint64(&r.hits)
+		if hits >= uint64(r.MaxHits) {
+			return hits, false
+		}
+		if atomic.CompareAndSwapUint64(&r.hits, hits, hits+1) {
+			return hits + 1, true
+		}
+	}
+}
+
+// Counters lists the counters of every rule
+func (p *Plan) Counters() []RuleCounter {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	out := []RuleCounter{}
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		for _, rule := range *rules {
+			out = append(out, RuleCounter{
+				Kind:    kind,
+				Rule:    rule.Name,
+				Matches: atomic.LoadUint64(&rule.matched),
+				Hits:    atomic.LoadUint64(&rule.hits),
+			})
+		}
+	}
+	return out
+}
+
+// ResetCounters zeroes the counters of the rules with the given name, or of every rule if ruleName is empty.
+// It returns the counters that were reset, as they were before.
+func (p *Plan) ResetCounters(ruleName string) []RuleCounter {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	out := []RuleCounter{}
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		for _, rule := range *rules {
+			if len(ruleName) > 0 && rule.Name != ruleName {
+				continue
+			}
+			out = append(out, RuleCounter{
+				Kind:    kind,
+				Rule:    rule.Name,
+				Matches: atomic.SwapUint64(&rule.matched, 0),
+				Hits:    atomic.SwapUint64(&rule.hits, 0),
+			})
+		}
+	}
+
+	// the exit condition of the current phase counts hits from zero again
+	p.phaseRule, p.phaseHits = p.phaseExitRule(), 0
+	if p.phaseRule != nil {
+		p.phaseHits = atomic.LoadUint64(&p.phaseRule.hits)
+	}
+	return out
+}
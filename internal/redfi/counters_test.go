@@ -0,0 +1,133 @@
+package redfi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSelectRuleHitLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     Rule
+		expected []bool
+	}{
+		{
+			name:     "only the first five commands",
+			rule:     Rule{MaxHits: 5},
+			expected: []bool{true, true, true, true, true, false, false},
+		},
+		{
+			name:     "the third command",
+			rule:     Rule{SkipFirst: 2, MaxHits: 1},
+			expected: []bool{false, false, true, false, false, false},
+		},
+		{
+			name:     "every third command",
+			rule:     Rule{EveryNth: 3},
+			expected: []bool{false, false, true, false, false, true, false},
+		},
+		{
+			name:     "every other command after the first two",
+			rule:     Rule{SkipFirst: 2, EveryNth: 2, MaxHits: 2},
+			expected: []bool{false, false, false, true, false, true, false, false},
+		},
+	}
+
+	for _, c := range cases {
+		rule := c.rule
+		rule.Name = "limited"
+		rule.Command = "SET"
+
+		err := rule.validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := &Plan{RequestRules: []*Rule{&rule}}
+		for i, expected := range c.expected {
+			output := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{}, command("SET a 1"), MakeLogger(-1))
+			if (output != nil) != expected {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s, SET #%d:\n\texpected match = %t", c.name, i+1, expected))
+			}
+		}
+	}
+}
+
+func TestHitLimitsValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{MaxHits: 1, SkipFirst: 2, EveryNth: 3}, expected: true},
+		{rule: Rule{MaxHits: -1}, expected: false},
+		{rule: Rule{SkipFirst: -1}, expected: false},
+		{rule: Rule{EveryNth: -1}, expected: false},
+	}
+
+	for i, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t#%d:\n\texpected valid = %t\n\toutput         = %v", i, c.expected, err))
+		}
+	}
+}
+
+func TestExhaustedRuleFallsThrough(t *testing.T) {
+	p := &Plan{RequestRules: []*Rule{
+		{Name: "first", Command: "GET", MaxHits: 1},
+		{Name: "second", Command: "GET"},
+	}}
+
+	selected := func() string {
+		rule := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{}, command("GET a"), MakeLogger(-1))
+		if rule == nil {
+			return ""
+		}
+		return rule.Name
+	}
+
+	for i, expected := range []string{"first", "second", "second"} {
+		if output := selected(); output != expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\tGET #%d:\n\texpected = %s\n\toutput   = %s", i+1, expected, output))
+		}
+	}
+
+	counters := p.Counters()
+	if len(counters) != 2 || counters[0].Hits != 1 || counters[0].Matches != 1 || counters[1].Hits != 2 {
+		t.Fatalf("unexpected counters: %+v", counters)
+	}
+
+	// resetting the counters lets the rule apply again
+	reset := p.ResetCounters("first")
+	if len(reset) != 1 || reset[0].Rule != "first" || reset[0].Hits != 1 {
+		t.Fatalf("unexpected reset counters: %+v", reset)
+	}
+	if output := selected(); output != "first" {
+		t.Fatalf("rule wasn't applied once its counters were reset: %s", output)
+	}
+
+	p.ResetCounters("")
+	for _, counter := range p.Counters() {
+		if counter.Hits != 0 || counter.Matches != 0 {
+			t.Fatalf("counters weren't reset: %+v", counter)
+		}
+	}
+}
+
+func TestSkippedMatchFallsThrough(t *testing.T) {
+	p := &Plan{RequestRules: []*Rule{
+		{Name: "third_set", Command: "SET", SkipFirst: 2, MaxHits: 1},
+		{Name: "first_five", Command: "SET", MaxHits: 5},
+	}}
+
+	expected := []string{"first_five", "first_five", "third_set", "first_five", "first_five", "first_five", ""}
+	for i, e := range expected {
+		output := ""
+		if rule := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{}, command("SET a 1"), MakeLogger(-1)); rule != nil {
+			output = rule.Name
+		}
+		if output != e {
+			t.Fatal(fmt.Sprintf("Case failed:\n\tSET #%d:\n\texpected = %s\n\toutput   = %s", i+1, e, output))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package redfi
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// StallAfterTruncate forwards nothing more to the side that got the truncated message, the connection stays open
+	StallAfterTruncate = "stall"
+	// CloseAfterTruncate closes the connection of the side that got the truncated message
+	CloseAfterTruncate = "close"
+)
+
+// Truncate delivers the first bytes of a message only, set either Bytes or Percentage
+type Truncate struct {
+	Bytes      int `json:"bytes,omitempty"`
+	Percentage int `json:"percentage,omitempty"`
+	// StallAfterTruncate, the default, or CloseAfterTruncate
+	Then string `json:"then,omitempty"`
+}
+
+func (t *Truncate) validate(ruleName string) error {
+	if (t.Bytes > 0) == (t.Percentage > 0) || t.Bytes < 0 || t.Percentage < 0 || t.Percentage > 100 {
+		return fmt.Errorf("truncate in rule '%s' is malformed, set either bytes or a percentage within 1-100", ruleName)
+	}
+
+	switch t.Then {
+	case "", StallAfterTruncate, CloseAfterTruncate:
+		return nil
+	}
+	return fmt.Errorf("truncate in rule '%s' is malformed, then must be '%s' or '%s'", ruleName, StallAfterTruncate, CloseAfterTruncate)
+}
+
+// length returns how many bytes of a message of the given size are delivered
+func (t *Truncate) length(size int) int {
+	n := t.Bytes
+	if t.Percentage > 0 {
+		n = size * t.Percentage / 100
+	}
+	if n > size {
+		n = size
+	}
+	return n
+}
+
+// Fragment splits a message in many small writes
+type Fragment struct {
+	// bytes per write, 1 by default
+	Size int `json:"size,omitempty"`
+	// milliseconds between writes
+	Delay int `json:"delay,omitempty"`
+}
+
+func (f *Fragment) validate(ruleName string) error {
+	if f.Size < 0 || f.Delay < 0 {
+		return fmt.Errorf("fragment in rule '%s' is malformed, size and delay can't be negative", ruleName)
+	}
+	return nil
+}
+
+// shapesDelivery reports whether a rule changes how a forwarded message is written
+func (r *Rule) shapesDelivery() bool {
+	return r.Bandwidth > 0 || r.Truncate != nil || r.Fragment != nil
+}
+
+// deliver writes a message as shaped by a rule: truncated, fragmented or throttled
+func (p *Plan) deliver(streamType string, buf []byte, rule *Rule, s *session, dst net.Conn, logger Logger) error {
+	if rule.Truncate != nil {
+		n := rule.Truncate.length(len(buf))
+		logger(1, fmt.Sprintf("%s :: Truncating message: rule = %s, size = %dB, delivered = %dB\n", streamType, rule.Name, len(buf), n))
+		buf = buf[:n]
+	}
+
+	size := len(buf)
+	var pause time.Duration
+	var th *throttle
+	if rule.Bandwidth > 0 {
+		th = p.throttleFor(rule, s)
+		size = th.chunkSize()
+		logger(1, fmt.Sprintf("%s :: Throttling message: rule = %s, bandwidth = %dB/s, size = %dB\n", streamType, rule.Name, rule.Bandwidth, len(buf)))
+	}
+	if rule.Fragment != nil {
+		size = rule.Fragment.Size
+		if size == 0 {
+			size = 1
+		}
+		pause = time.Duration(rule.Fragment.Delay) * time.Millisecond
+		logger(1, fmt.Sprintf("%s :: Fragmenting message: rule = %s, fragment size = %dB, size = %dB\n", streamType, rule.Name, size, len(buf)))
+	}
+
+	for i := 0; len(buf) > 0; i++ {
+		n := size
+		if n > len(buf) {
+			n = len(buf)
+		}
+
+		if i > 0 && pause > 0 {
+			time.Sleep(pause)
+		}
+		if th != nil {
+			time.Sleep(th.reserve(n))
+		}
+
+		_, err := dst.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+
+	if rule.Truncate != nil {
+		if rule.Truncate.Then == CloseAfterTruncate {
+			logger(1, fmt.Sprintf("%s :: Closing connection after truncated message: rule = %s\n", streamType, rule.Name))
+			return dst.Close()
+		}
+		logger(1, fmt.Sprintf("%s :: Stalling connection after truncated message: rule = %s\n", streamType, rule.Name))
+		s.stall(dst)
+	}
+	return nil
+}
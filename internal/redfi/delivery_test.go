@@ -0,0 +1,170 @@
+package redfi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTruncateLength(t *testing.T) {
+	cases := []struct {
+		truncate Truncate
+		size     int
+		expected int
+	}{
+		{truncate: Truncate{Bytes: 3}, size: 10, expected: 3},
+		{truncate: Truncate{Bytes: 30}, size: 10, expected: 10},
+		{truncate: Truncate{Percentage: 50}, size: 11, expected: 5},
+		{truncate: Truncate{Percentage: 100}, size: 11, expected: 11},
+	}
+
+	for _, c := range cases {
+		output := c.truncate.length(c.size)
+		if output != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%+v of %dB:\n\texpected = %d\n\toutput   = %d", c.truncate, c.size, c.expected, output))
+		}
+	}
+}
+
+func TestDeliveryValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{Truncate: &Truncate{Bytes: 3}}, expected: true},
+		{rule: Rule{Truncate: &Truncate{Percentage: 50, Then: CloseAfterTruncate}}, expected: true},
+		{rule: Rule{Truncate: &Truncate{}}, expected: false},
+		{rule: Rule{Truncate: &Truncate{Bytes: 3, Percentage: 50}}, expected: false},
+		{rule: Rule{Truncate: &Truncate{Percentage: 150}}, expected: false},
+		{rule: Rule{Truncate: &Truncate{Bytes: 3, Then: "reset"}}, expected: false},
+		{rule: Rule{Fragment: &Fragment{Size: 2, Delay: 5}}, expected: true},
+		{rule: Rule{Fragment: &Fragment{Size: -1}}, expected: false},
+	}
+
+	for i, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t#%d:\n\texpected valid = %t\n\toutput         = %v", i, c.expected, err))
+		}
+	}
+}
+
+// deliveryProxy starts a proxy to fakeRedis with the given response rules, and connects a client to it
+func deliveryProxy(t *testing.T, rules []*Rule) net.Conn {
+	_, conn := rulesProxy(t, nil, rules)
+	return conn
+}
+
+// rulesProxy starts a proxy to fakeRedis with the given rules, and connects a client to it
+func rulesProxy(t *testing.T, requestRules, responseRules []*Rule) (*Plan, net.Conn) {
+	dir := t.TempDir()
+	plan, addr := startProxy(t, "unix:"+filepath.Join(dir, "redfi.sock"), func(plan *Plan) {
+		plan.RequestRules = requestRules
+		plan.ResponseRules = responseRules
+	})
+
+	network, address := splitAddr(addr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return plan, conn
+}
+
+// startProxy starts a proxy to fakeRedis listening on proxyAddr, its plan set up by setup.
+// It returns the address the proxy listens on.
+func startProxy(t *testing.T, proxyAddr string, setup func(plan *Plan)) (*Plan, string) {
+	redisAddr := "unix:" + filepath.Join(t.TempDir(), "redis.sock")
+
+	redis := fakeRedis(t, redisAddr)
+	t.Cleanup(func() { redis.Close() })
+
+	p, err := New("", redisAddr, proxyAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(p.plan)
+
+	ln, err := listen(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go p.serve(ln, redisAddr, MakeLogger(-1))
+
+	if ln.Addr().Network() == "unix" {
+		return p.plan, "unix:" + ln.Addr().String()
+	}
+	return p.plan, ln.Addr().String()
+}
+
+func TestProxyTruncate(t *testing.T) {
+	cases := []struct {
+		name     string
+		then     string
+		expected string
+		// what the client gets next: io.EOF when the connection is closed, a timeout when stalled
+		closed bool
+	}{
+		{name: "close", then: CloseAfterTruncate, expected: "+tru", closed: true},
+		{name: "stall", then: StallAfterTruncate, expected: "+tru", closed: false},
+	}
+
+	for _, c := range cases {
+		conn := deliveryProxy(t, []*Rule{
+			{Name: "truncate", RawMatchAll: []string{"truncated"}, Truncate: &Truncate{Bytes: 4, Then: c.then}},
+		})
+
+		_, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$9\r\ntruncated\r\n*2\r\n$3\r\nGET\r\n$4\r\nnext\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 64)
+		n, err := io.ReadAtLeast(conn, buf, len(c.expected))
+		if err != nil || string(buf[:n]) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q, %v", c.name, c.expected, buf[:n], err))
+		}
+
+		// nothing else makes it to the client
+		n, err = conn.Read(buf)
+		timeout := false
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			timeout = true
+		}
+		if n > 0 || (c.closed && err != io.EOF) || (!c.closed && !timeout) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tunexpected read after truncated message: %q, %v", c.name, buf[:n], err))
+		}
+	}
+}
+
+func TestProxyFragment(t *testing.T) {
+	conn := deliveryProxy(t, []*Rule{
+		{Name: "fragment", AlwaysMatch: true, Fragment: &Fragment{Size: 2, Delay: 10}},
+	})
+
+	_, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$10\r\nfragmented\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	reply, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Raw) != "+fragmented\r\n" {
+		t.Fatalf("unexpected reply: %q", reply.Raw)
+	}
+
+	// 13 bytes in 7 writes, 10ms apart
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("reply wasn't fragmented: delivered in %s", elapsed)
+	}
+}
@@ -0,0 +1,156 @@
+package redfi
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// ClientSide is the connection between the client and the proxy
+	ClientSide = "client"
+	// UpstreamSide is the connection between the proxy and Redis
+	UpstreamSide = "upstream"
+	// BothSides are both connections of a client
+	BothSides = "both"
+)
+
+const (
+	// FinDisconnect closes the connection gracefully, the other side reads EOF
+	FinDisconnect = "fin"
+	// RstDisconnect resets the TCP connection, the other side gets "connection reset by peer"
+	RstDisconnect = "rst"
+	// CloseReadDisconnect stops reading from the connection, while still writing to it
+	CloseReadDisconnect = "closeRead"
+	// CloseWriteDisconnect stops writing to the connection, the other side reads EOF while its writes still go through
+	CloseWriteDisconnect = "closeWrite"
+)
+
+// Disconnect tears down the connection of a client, as CLIENT KILL, a Redis crash or a network failure do.
+// The matched message isn't forwarded.
+type Disconnect struct {
+	// ClientSide, the default, UpstreamSide or BothSides
+	Target string `json:"target,omitempty"`
+	// FinDisconnect, the default, RstDisconnect, CloseReadDisconnect or CloseWriteDisconnect
+	Mode string `json:"mode,omitempty"`
+	// error sent to the client first, e.g. "ERR Server closed the connection"
+	Message string `json:"message,omitempty"`
+}
+
+func (d *Disconnect) validate(ruleName string) error {
+	switch d.Target {
+	case "", ClientSide, UpstreamSide, BothSides:
+	default:
+		return fmt.Errorf("disconnect in rule '%s' is malformed, target must be '%s', '%s' or '%s'", ruleName, ClientSide, UpstreamSide, BothSides)
+	}
+
+	switch d.Mode {
+	case "", FinDisconnect, RstDisconnect, CloseReadDisconnect, CloseWriteDisconnect:
+		return nil
+	}
+	return fmt.Errorf("disconnect in rule '%s' is malformed, mode must be '%s', '%s', '%s' or '%s'", ruleName, FinDisconnect, RstDisconnect, CloseReadDisconnect, CloseWriteDisconnect)
+}
+
+// disconnects reports whether a rule tears down the connection instead of forwarding the message
+func (r *Rule) disconnects() bool {
+	return r.Drop || r.Disconnect != nil
+}
+
+// apply tears down conn as set by the mode
+func (d *Disconnect) apply(conn net.Conn) error {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	raw := conn
+	if isTLS {
+		raw = tlsConn.NetConn()
+	}
+
+	switch d.Mode {
+	case RstDisconnect:
+		l, ok := raw.(interface{ SetLinger(sec int) error })
+		if !ok {
+			return fmt.Errorf("can't reset %s connections", raw.LocalAddr().Network())
+		}
+		err := l.SetLinger(0)
+		if err != nil {
+			return err
+		}
+		// closing the TLS connection would send a close_notify alert first
+		return raw.Close()
+
+	case CloseReadDisconnect:
+		cr, ok := raw.(interface{ CloseRead() error })
+		if !ok {
+			return fmt.Errorf("can't half-close %s connections", raw.LocalAddr().Network())
+		}
+		return cr.CloseRead()
+
+	case CloseWriteDisconnect:
+		if isTLS {
+			return tlsConn.CloseWrite()
+		}
+		cw, ok := raw.(interface{ CloseWrite() error })
+		if !ok {
+			return fmt.Errorf("can't half-close %s connections", raw.LocalAddr().Network())
+		}
+		return cw.CloseWrite()
+	}
+
+	return conn.Close()
+}
+
+// disconnect applies the disconnect of a rule to the connections of a client, drop being a disconnect of the client
+func (p *Plan) disconnect(streamType string, rule *Rule, s *session, logger Logger) {
+	d := rule.Disconnect
+	if d == nil {
+		d = &Disconnect{}
+	}
+
+	target := d.Target
+	if len(target) == 0 {
+		target = ClientSide
+	}
+	mode := d.Mode
+	if len(mode) == 0 {
+		mode = FinDisconnect
+	}
+
+	if len(d.Message) > 0 && !s.stalled(s.client) {
+		_, err := s.client.Write(redcon.AppendError(nil, d.Message))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	conns := []net.Conn{s.client, s.upstream}
+	if target == ClientSide {
+		conns = conns[:1]
+	} else if target == UpstreamSide {
+		conns = conns[1:]
+	}
+
+	for _, conn := range conns {
+		side := ClientSide
+		if conn == s.upstream {
+			side = UpstreamSide
+		}
+		logger(1, fmt.Sprintf("%s :: Disconnecting %s: rule = %s, mode = %s\n", streamType, side, rule.Name, mode))
+
+		err := (&Disconnect{Mode: mode}).apply(conn)
+		if err != nil {
+			log.Println("encountered error while disconnecting, closing the connection instead:", err)
+			conn.Close()
+			continue
+		}
+
+		switch mode {
+		case CloseWriteDisconnect:
+			// nothing can be written to that side anymore
+			s.stall(conn)
+		case CloseReadDisconnect:
+			s.closeRead(conn)
+		}
+	}
+}
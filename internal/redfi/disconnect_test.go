@@ -0,0 +1,147 @@
+package redfi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDisconnectValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{Disconnect: &Disconnect{}}, expected: true},
+		{rule: Rule{Disconnect: &Disconnect{Target: BothSides, Mode: RstDisconnect, Message: "ERR Server closed the connection"}}, expected: true},
+		{rule: Rule{Disconnect: &Disconnect{Target: "redis"}}, expected: false},
+		{rule: Rule{Disconnect: &Disconnect{Mode: "abort"}}, expected: false},
+		{rule: Rule{Drop: true, Disconnect: &Disconnect{}}, expected: false},
+	}
+
+	for i, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t#%d:\n\texpected valid = %t\n\toutput         = %v", i, c.expected, err))
+		}
+	}
+}
+
+// tcpPair returns both ends of a TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestDisconnectApply(t *testing.T) {
+	cases := []struct {
+		mode string
+		// what the other end reads
+		expected error
+		// whether the other end can still write
+		writable bool
+	}{
+		{mode: FinDisconnect, expected: io.EOF},
+		{mode: RstDisconnect, expected: syscall.ECONNRESET},
+		{mode: CloseWriteDisconnect, expected: io.EOF, writable: true},
+	}
+
+	for _, c := range cases {
+		client, server := tcpPair(t)
+
+		err := (&Disconnect{Mode: c.mode}).apply(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read(make([]byte, 1))
+		if !errors.Is(err, c.expected) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %v\n\toutput   = %v", c.mode, c.expected, err))
+		}
+
+		if c.writable {
+			_, err = client.Write([]byte("ping"))
+			if err == nil {
+				_, err = io.ReadFull(server, make([]byte, 4))
+			}
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tother end can't write anymore: %v", c.mode, err))
+			}
+		}
+	}
+}
+
+func TestProxyDisconnect(t *testing.T) {
+	cases := []struct {
+		name          string
+		requestRules  []*Rule
+		responseRules []*Rule
+		// what the client reads before the connection ends, then whether it ends with EOF or a timeout
+		expected string
+		closed   bool
+	}{
+		{
+			name:          "drop on the response stream closes the client",
+			responseRules: []*Rule{{Name: "drop", AlwaysMatch: true, Drop: true}},
+			closed:        true,
+		},
+		{
+			name:         "client killed with a message",
+			requestRules: []*Rule{{Name: "kill", AlwaysMatch: true, Disconnect: &Disconnect{Message: "ERR Server closed the connection"}}},
+			expected:     "-ERR Server closed the connection\r\n",
+			closed:       true,
+		},
+		{
+			name:          "upstream closed",
+			responseRules: []*Rule{{Name: "crash", AlwaysMatch: true, Disconnect: &Disconnect{Target: UpstreamSide, Message: "ERR upstream gone"}}},
+			expected:      "-ERR upstream gone\r\n",
+			closed:        false,
+		},
+		{
+			name:         "client half-closed for writing",
+			requestRules: []*Rule{{Name: "fin", AlwaysMatch: true, Disconnect: &Disconnect{Mode: CloseWriteDisconnect}}},
+			closed:       true,
+		},
+	}
+
+	for _, c := range cases {
+		_, conn := rulesProxy(t, c.requestRules, c.responseRules)
+
+		_, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		output, err := io.ReadAll(bufio.NewReader(conn))
+		timeout := false
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			timeout = true
+		}
+		if string(output) != c.expected || (c.closed && err != nil) || (!c.closed && !timeout) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q, closed = %t\n\toutput   = %q, %v", c.name, c.expected, c.closed, output, err))
+		}
+	}
+}
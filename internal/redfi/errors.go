@@ -0,0 +1,54 @@
+package redfi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// errorPresets holds the errors real Redis answers with, by the name of their prefix.
+// %s is replaced with the lowercase command name.
+var errorPresets = map[string]string{
+	"LOADING":     "LOADING Redis is loading the dataset in memory",
+	"BUSY":        "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.",
+	"READONLY":    "READONLY You can't write against a read only replica.",
+	"OOM":         "OOM command not allowed when used memory > 'maxmemory'.",
+	"MASTERDOWN":  "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.",
+	"CLUSTERDOWN": "CLUSTERDOWN The cluster is down",
+	"TRYAGAIN":    "TRYAGAIN Multiple keys request during rehashing of slot",
+	"NOSCRIPT":    "NOSCRIPT No matching script. Please use EVAL.",
+	"MISCONF": "MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk. " +
+		"Commands that may modify the data set are disabled, because this instance is configured to report errors during writes " +
+		"if RDB snapshotting fails (stop-writes-on-bgsave-error option). Please check the Redis logs for details about the RDB error.",
+	"NOREPLICAS": "NOREPLICAS Not enough good replicas to write.",
+	"EXECABORT":  "EXECABORT Transaction discarded because of previous errors.",
+	"NOPERM":     "NOPERM User default has no permissions to run the '%s' command",
+}
+
+func validateError(r *Rule) error {
+	if len(r.Error) == 0 {
+		return nil
+	}
+	if len(r.ReturnErr) > 0 {
+		return fmt.Errorf("rule '%s' is malformed, error and returnErr can't be used together", r.Name)
+	}
+	if _, ok := errorPresets[r.Error]; !ok {
+		return fmt.Errorf("error in rule '%s' is malformed, unknown error '%s'", r.Name, r.Error)
+	}
+	return nil
+}
+
+// presetError returns the error reply of a preset for the given request
+func presetError(name string, req redcon.RESP) []byte {
+	msg := errorPresets[name]
+	if strings.Contains(msg, "%s") {
+		command := ""
+		args, err := respArrToSlice(req)
+		if err == nil && len(args) > 0 {
+			command = strings.ToLower(string(args[0].Data))
+		}
+		msg = fmt.Sprintf(msg, command)
+	}
+	return redcon.AppendError(nil, msg)
+}
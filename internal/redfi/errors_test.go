@@ -0,0 +1,62 @@
+package redfi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPresetError(t *testing.T) {
+	cases := []struct {
+		preset   string
+		command  string
+		expected string
+	}{
+		{preset: "LOADING", command: "GET a", expected: "-LOADING Redis is loading the dataset in memory\r\n"},
+		{preset: "READONLY", command: "SET a 1", expected: "-READONLY You can't write against a read only replica.\r\n"},
+		{preset: "OOM", command: "SET a 1", expected: "-OOM command not allowed when used memory > 'maxmemory'.\r\n"},
+		{preset: "CLUSTERDOWN", command: "GET a", expected: "-CLUSTERDOWN The cluster is down\r\n"},
+		{preset: "EXECABORT", command: "EXEC", expected: "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{preset: "NOPERM", command: "FLUSHALL", expected: "-NOPERM User default has no permissions to run the 'flushall' command\r\n"},
+	}
+
+	for _, c := range cases {
+		rule := &Rule{Name: "error", Error: c.preset}
+		err := rule.validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output := string(rule.syntheticReply(command(c.command)))
+		if output != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.preset, c.expected, output))
+		}
+	}
+
+	// every preset is an error prefixed by its name
+	for name := range errorPresets {
+		output := string(presetError(name, command("GET a")))
+		if !strings.HasPrefix(output, "-"+name+" ") || !strings.HasSuffix(output, "\r\n") || strings.Count(output, "\r\n") != 1 {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tmalformed error = %q", name, output))
+		}
+	}
+}
+
+func TestPresetErrorValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{Error: "BUSY"}, expected: true},
+		{rule: Rule{Error: "busy"}, expected: false},
+		{rule: Rule{Error: "WRONGTYPE"}, expected: false},
+		{rule: Rule{Error: "BUSY", ReturnErr: "ERR busy"}, expected: false},
+	}
+
+	for _, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%+v:\n\texpected valid = %t\n\toutput         = %v", c.rule, c.expected, err))
+		}
+	}
+}
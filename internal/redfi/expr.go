@@ -0,0 +1,850 @@
+package redfi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/tidwall/redcon"
+)
+
+// The `when` directive of a rule holds an expression over the message being matched,
+// compiled once when the rule is validated. See the README for the language.
+
+// exprVars lists the variables an expression can refer to
+var exprVars = map[string]bool{
+	"cmd":           true,
+	"args":          true,
+	"keys":          true,
+	"raw":           true,
+	"stream":        true,
+	"client.addr":   true,
+	"client.name":   true,
+	"client.id":     true,
+	"upstream.addr": true,
+	"rule.name":     true,
+	"rule.hits":     true,
+}
+
+// exprFuncs lists the functions an expression can call, along with their number of arguments
+var exprFuncs = map[string]int{
+	"len":    1,
+	"lower":  1,
+	"upper":  1,
+	"number": 1,
+	"hits":   1,
+}
+
+// exprEnv is what an expression is evaluated against
+type exprEnv struct {
+	plan   *Plan
+	rule   *Rule
+	stream string
+	conn   *ConnInfo
+	msg    redcon.RESP
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+// compileExpr parses an expression, which must evaluate to a boolean
+func compileExpr(src string) (exprNode, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &exprParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", parser.peek(), parser.peek().pos)
+	}
+	return node, nil
+}
+
+// evalWhen reports whether the `when` expression of a rule holds for a message,
+// an expression that fails to evaluate doesn't hold
+func (p *Plan) evalWhen(rule *Rule, streamType string, conn *ConnInfo, msg redcon.RESP, log Logger) bool {
+	env := &exprEnv{plan: p, rule: rule, stream: strings.ToLower(streamType), conn: conn, msg: msg}
+	value, err := rule.when.eval(env)
+	if err != nil {
+		log(2, fmt.Sprintf("when expression of rule '%s' failed: %s\n", rule.Name, err))
+		return false
+	}
+
+	b, ok := value.(bool)
+	if !ok {
+		log(2, fmt.Sprintf("when expression of rule '%s' isn't a boolean: %v\n", rule.Name, value))
+		return false
+	}
+	return b
+}
+
+// request returns the request a message is, or the request it answers
+func (env *exprEnv) request() []string {
+	req := env.msg
+	if env.conn.Request.Exists() {
+		req = env.conn.Request
+	}
+
+	args, err := respArrToSlice(req)
+	if err != nil {
+		return nil
+	}
+
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg.Data)
+	}
+	return strs
+}
+
+func (env *exprEnv) lookup(name string) interface{} {
+	switch name {
+	case "cmd":
+		req := env.request()
+		if len(req) == 0 {
+			return ""
+		}
+		return strings.ToLower(req[0])
+	case "args":
+		req := env.request()
+		list := []interface{}{}
+		for i := 1; i < len(req); i++ {
+			list = append(list, req[i])
+		}
+		return list
+	case "keys":
+		req := env.msg
+		if env.conn.Request.Exists() {
+			req = env.conn.Request
+		}
+		list := []interface{}{}
+		for _, key := range commandKeys(req) {
+			list = append(list, string(key))
+		}
+		return list
+	case "raw":
+		return string(env.msg.Data)
+	case "stream":
+		return env.stream
+	case "client.addr":
+		return env.conn.ClientAddr
+	case "client.name":
+		env.plan.m.RLock()
+		name := env.plan.clientNameMap[env.conn.ClientAddr]
+		env.plan.m.RUnlock()
+		return name
+	case "client.id":
+		return float64(env.conn.ID)
+	case "upstream.addr":
+		return env.conn.UpstreamAddr
+	case "rule.name":
+		return env.rule.Name
+	case "rule.hits":
+		return float64(atomic.LoadUint64(&env.rule.hits))
+	}
+	return nil
+}
+
+// ruleHits returns the hits of the rule with the given name, whichever stream it applies to
+func (p *Plan) ruleHits(name string) float64 {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		for _, rule := range *rules {
+			if rule.Name == name {
+				return float64(atomic.LoadUint64(&rule.hits))
+			}
+		}
+	}
+	return 0
+}
+
+// lexer
+
+const (
+	tokEOF = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind  int
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", "."}
+
+func lexExpr(src string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	i := 0
+
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			value, err := strconv.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed string at offset %d", i)
+			}
+			tokens = append(tokens, exprToken{kind: tokString, text: src[i : end+1], value: value, pos: i})
+			i = end + 1
+
+		case unicode.IsDigit(c):
+			end := i
+			for end < len(src) && (unicode.IsDigit(rune(src[end])) || src[end] == '.') {
+				end++
+			}
+			value, err := strconv.ParseFloat(src[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed number at offset %d", i)
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, text: src[i:end], value: value, pos: i})
+			i = end
+
+		case unicode.IsLetter(c) || c == '_':
+			end := i
+			for end < len(src) && (unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end])) || src[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: src[i:end], pos: i})
+			i = end
+
+		default:
+			found := false
+			for _, op := range exprOps {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character '%c' at offset %d", c, i)
+			}
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+// parser, from lowest to highest precedence:
+// ||, &&, comparisons, + -, * / %, unary ! -, then literals, variables, calls and indexes
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokIdent {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return fmt.Errorf("expected '%s' but found %s at offset %d", op, p.peek(), p.peek().pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=", "startsWith", "endsWith", "contains", "matches", "in") {
+		op := p.next().text
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		node := &binaryNode{op: op, left: left, right: right}
+		if lit, ok := right.(*literalNode); ok && op == "matches" {
+			pattern, ok := lit.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("'matches' takes a string pattern")
+			}
+			node.regex, err = regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return node, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.next().text
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*", "/", "%") {
+		op := p.next().text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!", "-") {
+		op := p.next().text
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("[") {
+		p.next()
+		index, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect("]")
+		if err != nil {
+			return nil, err
+		}
+		node = &indexNode{target: node, index: index}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber, tokString:
+		return &literalNode{value: t.value}, nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		}
+
+		if p.isOp("(") {
+			arity, ok := exprFuncs[t.text]
+			if !ok {
+				return nil, fmt.Errorf("unknown function '%s' at offset %d", t.text, t.pos)
+			}
+			p.next()
+			args := []exprNode{}
+			for !p.isOp(")") {
+				if len(args) > 0 {
+					err := p.expect(",")
+					if err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+			}
+			p.next()
+			if len(args) != arity {
+				return nil, fmt.Errorf("function '%s' takes %d argument(s)", t.text, arity)
+			}
+			return &callNode{name: t.text, args: args}, nil
+		}
+
+		name := t.text
+		for p.isOp(".") {
+			p.next()
+			field := p.next()
+			if field.kind != tokIdent {
+				return nil, fmt.Errorf("expected a field name but found %s at offset %d", field, field.pos)
+			}
+			name += "." + field.text
+		}
+		if !exprVars[name] {
+			return nil, fmt.Errorf("unknown variable '%s' at offset %d", name, t.pos)
+		}
+		return &varNode{name: name}, nil
+
+	case tokOp:
+		switch t.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			items := []exprNode{}
+			for !p.isOp("]") {
+				if len(items) > 0 {
+					err := p.expect(",")
+					if err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			p.next()
+			return &listNode{items: items}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s at offset %d", t, t.pos)
+}
+
+// nodes
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(env *exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+type varNode struct {
+	name string
+}
+
+func (n *varNode) eval(env *exprEnv) (interface{}, error) {
+	return env.lookup(n.name), nil
+}
+
+type listNode struct {
+	items []exprNode
+}
+
+func (n *listNode) eval(env *exprEnv) (interface{}, error) {
+	list := []interface{}{}
+	for _, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n *callNode) eval(env *exprEnv) (interface{}, error) {
+	arg, err := n.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.name {
+	case "len":
+		switch v := arg.(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		}
+	case "lower", "upper":
+		if s, ok := arg.(string); ok {
+			if n.name == "lower" {
+				return strings.ToLower(s), nil
+			}
+			return strings.ToUpper(s), nil
+		}
+	case "number":
+		if f, ok := toNumber(arg); ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%v isn't a number", arg)
+	case "hits":
+		if s, ok := arg.(string); ok {
+			return env.plan.ruleHits(s), nil
+		}
+	}
+	return nil, fmt.Errorf("%s() doesn't apply to %v", n.name, arg)
+}
+
+type indexNode struct {
+	target exprNode
+	index  exprNode
+}
+
+func (n *indexNode) eval(env *exprEnv) (interface{}, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := target.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v isn't a list", target)
+	}
+	f, ok := index.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%v isn't an index", index)
+	}
+	// out of range indexes evaluate to an empty string, so `args[3] == "EX"` works on short commands
+	i := int(f)
+	if i < 0 || i >= len(list) {
+		return "", nil
+	}
+	return list[i], nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "!" {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! doesn't apply to %v", value)
+		}
+		return !b, nil
+	}
+
+	f, ok := toNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("- doesn't apply to %v", value)
+	}
+	return -f, nil
+}
+
+type logicalNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *logicalNode) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	left, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't apply to %v", n.op, value)
+	}
+
+	// short circuit
+	if (n.op == "&&" && !left) || (n.op == "||" && left) {
+		return left, nil
+	}
+
+	value, err = n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't apply to %v", n.op, value)
+	}
+	return right, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+	// compiled pattern of `matches` when given as a literal
+	regex *regexp.Regexp
+}
+
+func (n *binaryNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+
+	case "<", "<=", ">", ">=":
+		l, lok := toNumber(left)
+		r, rok := toNumber(right)
+		if !lok || !rok {
+			ls, lok := left.(string)
+			rs, rok := right.(string)
+			if !lok || !rok {
+				return nil, fmt.Errorf("%v %s %v compares values of different types", left, n.op, right)
+			}
+			return compareOrdered(strings.Compare(ls, rs), n.op), nil
+		}
+		switch {
+		case l < r:
+			return compareOrdered(-1, n.op), nil
+		case l > r:
+			return compareOrdered(1, n.op), nil
+		}
+		return compareOrdered(0, n.op), nil
+
+	case "startsWith", "endsWith", "contains":
+		if list, ok := left.([]interface{}); ok && n.op == "contains" {
+			return exprIn(right, list), nil
+		}
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if !lok || !rok {
+			return nil, fmt.Errorf("%s doesn't apply to %v and %v", n.op, left, right)
+		}
+		switch n.op {
+		case "startsWith":
+			return strings.HasPrefix(ls, rs), nil
+		case "endsWith":
+			return strings.HasSuffix(ls, rs), nil
+		}
+		return strings.Contains(ls, rs), nil
+
+	case "matches":
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if !lok || !rok {
+			return nil, fmt.Errorf("matches doesn't apply to %v and %v", left, right)
+		}
+		regex := n.regex
+		if regex == nil {
+			regex, err = regexp.Compile(rs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return regex.MatchString(ls), nil
+
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("in doesn't apply to %v", right)
+		}
+		return exprIn(left, list), nil
+
+	case "+":
+		if ls, ok := left.(string); ok {
+			if rs, ok := right.(string); ok {
+				return ls + rs, nil
+			}
+		}
+	}
+
+	// arithmetic
+	l, lok := toNumber(left)
+	r, rok := toNumber(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s doesn't apply to %v and %v", n.op, left, right)
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+	if int64(r) == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	return float64(int64(l) % int64(r)), nil
+}
+
+// toNumber converts numbers, and strings holding numbers, as RESP arguments are strings
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// exprEqual compares values, numerically when either is a number
+func exprEqual(left, right interface{}) bool {
+	_, lnum := left.(float64)
+	_, rnum := right.(float64)
+	if lnum || rnum {
+		l, lok := toNumber(left)
+		r, rok := toNumber(right)
+		return lok && rok && l == r
+	}
+
+	switch l := left.(type) {
+	case string, bool:
+		return l == right
+	case []interface{}:
+		r, ok := right.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !exprEqual(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func exprIn(value interface{}, list []interface{}) bool {
+	for _, item := range list {
+		if exprEqual(value, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareOrdered(cmp int, op string) bool {
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
@@ -0,0 +1,144 @@
+package redfi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompileExpr(t *testing.T) {
+	cases := []struct {
+		expr  string
+		error string
+	}{
+		{expr: `cmd == "set" && len(args) > 2 && client.name startsWith "worker"`},
+		{expr: `cmd in ["get", "mget"] || !(raw contains "PING")`},
+		{expr: `rule.hits % 2 == 0 && hits("other") >= 10`},
+		{expr: `args[0] matches "^user:[0-9]+$"`},
+		{expr: `cmd ==`, error: "unexpected end of expression"},
+		{expr: `command == "set"`, error: "unknown variable 'command'"},
+		{expr: `client.nickname == "a"`, error: "unknown variable 'client.nickname'"},
+		{expr: `size(args) > 1`, error: "unknown function 'size'"},
+		{expr: `len(args, keys) > 1`, error: "takes 1 argument"},
+		{expr: `cmd == "set`, error: "unterminated string"},
+		{expr: `raw matches "("`, error: "missing closing )"},
+		{expr: `cmd == "a" cmd`, error: "unexpected 'cmd'"},
+	}
+
+	for _, c := range cases {
+		_, err := compileExpr(c.expr)
+		output := ""
+		if err != nil {
+			output = err.Error()
+		}
+		if (len(c.error) == 0 && err != nil) || !strings.Contains(output, c.error) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %s\n\toutput   = %s", c.expr, c.error, output))
+		}
+	}
+}
+
+func TestSelectRuleWhen(t *testing.T) {
+	cases := []struct {
+		name       string
+		rule       *Rule
+		clientAddr string
+		command    string
+		expected   bool
+	}{
+		{
+			name:       "example from the README",
+			rule:       &Rule{When: `cmd == "set" && len(args) > 2 && client.name startsWith "worker"`},
+			clientAddr: "10.0.0.1:1000",
+			command:    "SET a 1 EX 10",
+			expected:   true,
+		},
+		{
+			name:       "client name doesn't match",
+			rule:       &Rule{When: `cmd == "set" && len(args) > 2 && client.name startsWith "worker"`},
+			clientAddr: "10.0.0.2:1000",
+			command:    "SET a 1 EX 10",
+			expected:   false,
+		},
+		{
+			name:       "numeric comparison on an argument",
+			rule:       &Rule{When: `cmd == "expire" && args[1] > 3600`},
+			clientAddr: "10.0.0.1:1000",
+			command:    "EXPIRE a 7200",
+			expected:   true,
+		},
+		{
+			name:       "keys",
+			rule:       &Rule{When: `"b" in keys`},
+			clientAddr: "10.0.0.1:1000",
+			command:    "MGET a b",
+			expected:   true,
+		},
+		{
+			name:       "combined with other directives",
+			rule:       &Rule{Command: "GET", When: `args[0] endsWith ":1"`},
+			clientAddr: "10.0.0.1:1000",
+			command:    "DEL user:1",
+			expected:   false,
+		},
+		{
+			name:       "failing evaluation doesn't match",
+			rule:       &Rule{When: `number(args[0]) > 1`},
+			clientAddr: "10.0.0.1:1000",
+			command:    "GET a",
+			expected:   false,
+		},
+		{
+			name:       "non boolean doesn't match",
+			rule:       &Rule{When: `cmd`},
+			clientAddr: "10.0.0.1:1000",
+			command:    "GET a",
+			expected:   false,
+		},
+	}
+
+	for _, c := range cases {
+		c.rule.Name = "when"
+		err := c.rule.validate()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\terror = %s", c.name, err))
+		}
+
+		p := &Plan{
+			RequestRules:  []*Rule{c.rule},
+			clientNameMap: map[string]string{"10.0.0.1:1000": "worker-1", "10.0.0.2:1000": "web-1"},
+		}
+		output := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{ClientAddr: c.clientAddr}, command(c.command), MakeLogger(-1))
+		if (output != nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected match = %t", c.name, c.expected))
+		}
+	}
+}
+
+func TestSelectRuleWhenHits(t *testing.T) {
+	// the first two commands only
+	rule := &Rule{Name: "first_two", When: `rule.hits < 2 && hits("first_two") == rule.hits`}
+	err := rule.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Plan{RequestRules: []*Rule{rule}}
+	matched := []bool{}
+	for i := 0; i < 4; i++ {
+		output := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{}, command("GET a"), MakeLogger(-1))
+		matched = append(matched, output != nil)
+	}
+
+	expected := []bool{true, true, false, false}
+	if fmt.Sprint(matched) != fmt.Sprint(expected) {
+		t.Fatal(fmt.Sprintf("Case failed:\n\texpected = %v\n\toutput   = %v", expected, matched))
+	}
+}
+
+func TestWhenMalformed(t *testing.T) {
+	rule := &Rule{Name: "bad", When: `cmd = "set"`}
+	err := rule.validate()
+	if err == nil || !strings.Contains(err.Error(), "rule 'bad'") {
+		t.Fatal(fmt.Sprintf("expected an error against the rule name, got %v", err))
+	}
+}
@@ -0,0 +1,163 @@
+package redfi
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// keySpec locates the key arguments of a command, like the legacy first/last/step of COMMAND INFO.
+// Arguments are numbered from the command name, which is 0, and a negative last counts from the end,
+// -1 being the last argument.
+type keySpec struct {
+	first, last, step int
+}
+
+// keySpecs holds the commands whose keys aren't simply their first argument
+var keySpecs = map[string]keySpec{
+	"del": {1, -1, 1}, "unlink": {1, -1, 1}, "exists": {1, -1, 1}, "touch": {1, -1, 1}, "watch": {1, -1, 1},
+	"mget": {1, -1, 1}, "mset": {1, -1, 2}, "msetnx": {1, -1, 2},
+	"rename": {1, 2, 1}, "renamenx": {1, 2, 1}, "copy": {1, 2, 1},
+	"rpoplpush": {1, 2, 1}, "lmove": {1, 2, 1}, "brpoplpush": {1, 2, 1}, "blmove": {1, 2, 1}, "smove": {1, 2, 1},
+	"blpop": {1, -2, 1}, "brpop": {1, -2, 1}, "bzpopmin": {1, -2, 1}, "bzpopmax": {1, -2, 1},
+	"sinter": {1, -1, 1}, "sunion": {1, -1, 1}, "sdiff": {1, -1, 1},
+	"sinterstore": {1, -1, 1}, "sunionstore": {1, -1, 1}, "sdiffstore": {1, -1, 1},
+	"pfcount": {1, -1, 1}, "pfmerge": {1, -1, 1},
+	"bitop": {2, -1, 1}, "object": {2, 2, 1}, "memory": {2, 2, 1},
+}
+
+// numKeysSpecs holds the commands that give their number of keys as an argument,
+// mapping them to the position of that argument. Keys follow it, and a destination key
+// may come before it as the first argument.
+var numKeysSpecs = map[string]struct {
+	numKeys     int
+	destination bool
+}{
+	"eval": {2, false}, "evalsha": {2, false}, "eval_ro": {2, false}, "evalsha_ro": {2, false},
+	"fcall": {2, false}, "fcall_ro": {2, false},
+	"zunion": {1, false}, "zinter": {1, false}, "zdiff": {1, false}, "zintercard": {1, false},
+	"sintercard": {1, false}, "lmpop": {1, false}, "zmpop": {1, false},
+	"blmpop": {2, false}, "bzmpop": {2, false},
+	"zunionstore": {2, true}, "zinterstore": {2, true}, "zdiffstore": {2, true},
+}
+
+// keylessCommands holds the commands that take no keys, or whose first argument isn't a key
+var keylessCommands = map[string]bool{
+	"acl": true, "asking": true, "auth": true, "bgrewriteaof": true, "bgsave": true, "client": true,
+	"cluster": true, "command": true, "config": true, "dbsize": true, "debug": true, "discard": true,
+	"echo": true, "exec": true, "failover": true, "flushall": true, "flushdb": true, "function": true,
+	"hello": true, "info": true, "keys": true, "lastsave": true, "latency": true, "lolwut": true,
+	"module": true, "monitor": true, "multi": true, "ping": true, "psubscribe": true, "psync": true,
+	"publish": true, "pubsub": true, "punsubscribe": true, "quit": true, "randomkey": true,
+	"readonly": true, "readwrite": true, "replicaof": true, "reset": true, "role": true, "save": true,
+	"scan": true, "script": true, "select": true, "sentinel": true, "shutdown": true, "slaveof": true,
+	"slowlog": true, "spublish": true, "ssubscribe": true, "subscribe": true, "sunsubscribe": true,
+	"swapdb": true, "sync": true, "time": true, "unsubscribe": true, "unwatch": true, "wait": true,
+	"waitaof": true,
+}
+
+// commandKeys returns the key arguments of a request
+func commandKeys(req redcon.RESP) [][]byte {
+	args, err := respArrToSlice(req)
+	if err != nil || len(args) < 2 {
+		return nil
+	}
+
+	name := rlower(args[0])
+	if keylessCommands[name] {
+		return nil
+	}
+
+	if spec, ok := numKeysSpecs[name]; ok {
+		keys := [][]byte{}
+		if spec.destination {
+			keys = append(keys, args[1].Data)
+		}
+		if spec.numKeys >= len(args) {
+			return keys
+		}
+		numKeys, err := strconv.Atoi(string(args[spec.numKeys].Data))
+		if err != nil {
+			return keys
+		}
+		for i := spec.numKeys + 1; i <= spec.numKeys+numKeys && i < len(args); i++ {
+			keys = append(keys, args[i].Data)
+		}
+		return keys
+	}
+
+	switch name {
+	case "xread", "xreadgroup":
+		// XREAD ... STREAMS key [key ...] id [id ...]
+		for i := 1; i < len(args); i++ {
+			if rlower(args[i]) == "streams" {
+				streams := args[i+1:]
+				keys := [][]byte{}
+				for _, key := range streams[:len(streams)/2] {
+					keys = append(keys, key.Data)
+				}
+				return keys
+			}
+		}
+		return nil
+
+	case "migrate":
+		// MIGRATE host port key|"" destination-db timeout ... [KEYS key [key ...]]
+		if len(args) > 3 && len(args[3].Data) > 0 {
+			return [][]byte{args[3].Data}
+		}
+		for i := 6; i < len(args); i++ {
+			if rlower(args[i]) == "keys" {
+				keys := [][]byte{}
+				for _, key := range args[i+1:] {
+					keys = append(keys, key.Data)
+				}
+				return keys
+			}
+		}
+		return nil
+
+	case "sort", "sort_ro", "georadius", "georadiusbymember":
+		// the destination of STORE and STOREDIST is a key too
+		keys := [][]byte{args[1].Data}
+		for i := 2; i < len(args)-1; i++ {
+			if opt := rlower(args[i]); opt == "store" || opt == "storedist" {
+				keys = append(keys, args[i+1].Data)
+			}
+		}
+		return keys
+	}
+
+	spec, ok := keySpecs[name]
+	if !ok {
+		// most commands take a single key as their first argument
+		spec = keySpec{1, 1, 1}
+	}
+
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+
+	keys := [][]byte{}
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i].Data)
+	}
+	return keys
+}
+
+// matchesKeys reports whether any key of the request matches the key matchers
+func matchesKeys(rule *Matcher, req redcon.RESP) bool {
+	for _, key := range commandKeys(req) {
+		if len(rule.KeyPrefix) > 0 && !strings.HasPrefix(string(key), rule.KeyPrefix) {
+			continue
+		}
+		if len(rule.KeyPattern) > 0 && !match.Match(string(key), rule.KeyPattern) {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package redfi
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+// command builds a RESP request from space separated arguments
+func command(args string) redcon.RESP {
+	buf := []byte{}
+	parts := strings.Split(args, " ")
+	buf = redcon.AppendArray(buf, len(parts))
+	for _, part := range parts {
+		buf = redcon.AppendBulkString(buf, part)
+	}
+	return Resp(buf)
+}
+
+func TestCommandKeys(t *testing.T) {
+	cases := []struct {
+		command  string
+		expected []string
+	}{
+		{command: "GET user:1", expected: []string{"user:1"}},
+		{command: "SET user:1 user:2 EX 10", expected: []string{"user:1"}},
+		{command: "MGET a b c", expected: []string{"a", "b", "c"}},
+		{command: "MSET a 1 b 2", expected: []string{"a", "b"}},
+		{command: "DEL a b", expected: []string{"a", "b"}},
+		{command: "BLPOP a b 0", expected: []string{"a", "b"}},
+		{command: "EVAL script 2 a b arg", expected: []string{"a", "b"}},
+		{command: "ZUNIONSTORE dst 2 a b WEIGHTS 1 2", expected: []string{"dst", "a", "b"}},
+		{command: "LMPOP 2 a b LEFT", expected: []string{"a", "b"}},
+		{command: "XREAD COUNT 2 STREAMS a b 0 0", expected: []string{"a", "b"}},
+		{command: "BITOP AND dst a b", expected: []string{"dst", "a", "b"}},
+		{command: "OBJECT ENCODING a", expected: []string{"a"}},
+		{command: "SORT a BY w STORE dst", expected: []string{"a", "dst"}},
+		{command: "PUBLISH channel message", expected: nil},
+		{command: "PING", expected: nil},
+	}
+
+	for _, c := range cases {
+		keys := []string{}
+		for _, key := range commandKeys(command(c.command)) {
+			keys = append(keys, string(key))
+		}
+		if len(keys) == 0 && c.expected == nil {
+			continue
+		}
+		if !reflect.DeepEqual(keys, c.expected) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.command, c.expected, keys))
+		}
+	}
+}
+
+func TestSelectRuleKeyPattern(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     *Rule
+		command  string
+		expected bool
+	}{
+		{
+			name:     "glob matches a key",
+			rule:     &Rule{KeyPattern: "user:*"},
+			command:  "GET user:1",
+			expected: true,
+		},
+		{
+			name:     "glob doesn't match values",
+			rule:     &Rule{KeyPattern: "user:*"},
+			command:  "SET session:1 user:1",
+			expected: false,
+		},
+		{
+			name:     "prefix matches one of many keys",
+			rule:     &Rule{KeyPrefix: "user:"},
+			command:  "MGET session:1 user:1",
+			expected: true,
+		},
+		{
+			name:     "prefix matches EVAL keys only",
+			rule:     &Rule{KeyPrefix: "user:"},
+			command:  "EVAL user:1 1 session:1 user:2",
+			expected: false,
+		},
+		{
+			name:     "command and key must both match",
+			rule:     &Rule{Command: "GET", KeyPattern: "user:*"},
+			command:  "DEL user:1",
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		p := &Plan{RequestRules: []*Rule{c.rule}}
+		output := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{}, command(c.command), MakeLogger(-1))
+		if (output != nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected match = %t", c.name, c.expected))
+		}
+	}
+}
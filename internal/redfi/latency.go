@@ -0,0 +1,151 @@
+package redfi
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// UniformLatency spreads delays evenly between min and max
+	UniformLatency = "uniform"
+	// NormalLatency centers delays on mean, with a standard deviation of stdDev
+	NormalLatency = "normal"
+	// ExponentialLatency gives delays of the given mean, mostly short with occasional long ones
+	ExponentialLatency = "exponential"
+	// LogNormalLatency gives delays of the given median with a long tail, set by sigma
+	LogNormalLatency = "lognormal"
+	// ParetoLatency gives delays of at least scale with a heavy tail, which gets longer as shape decreases
+	ParetoLatency = "pareto"
+)
+
+// Latency describes a random delay, in milliseconds, added to the fixed delay of a rule
+type Latency struct {
+	Distribution string `json:"distribution"`
+
+	// uniform
+	Min float64 `json:"min,omitempty"`
+	Max float64 `json:"max,omitempty"`
+	// normal, exponential
+	Mean   float64 `json:"mean,omitempty"`
+	StdDev float64 `json:"stdDev,omitempty"`
+	// lognormal
+	Median float64 `json:"median,omitempty"`
+	Sigma  float64 `json:"sigma,omitempty"`
+	// pareto
+	Scale float64 `json:"scale,omitempty"`
+	Shape float64 `json:"shape,omitempty"`
+
+	// upper bound of the delay, whatever the distribution
+	Cap float64 `json:"cap,omitempty"`
+}
+
+func (l *Latency) validate(ruleName string) error {
+	malformed := func(reason string) error {
+		return fmt.Errorf("latency in rule '%s' is malformed, %s", ruleName, reason)
+	}
+
+	if l.Cap < 0 {
+		return malformed("cap can't be negative")
+	}
+
+	switch l.Distribution {
+	case UniformLatency:
+		if l.Min < 0 || l.Max < l.Min {
+			return malformed("min and max must hold 0 <= min <= max")
+		}
+	case NormalLatency:
+		if l.StdDev < 0 {
+			return malformed("stdDev can't be negative")
+		}
+	case ExponentialLatency:
+		if l.Mean <= 0 {
+			return malformed("mean must be positive")
+		}
+	case LogNormalLatency:
+		if l.Median <= 0 || l.Sigma < 0 {
+			return malformed("median must be positive and sigma can't be negative")
+		}
+	case ParetoLatency:
+		if l.Scale <= 0 || l.Shape <= 0 {
+			return malformed("scale and shape must be positive")
+		}
+	default:
+		return malformed(fmt.Sprintf("unknown distribution '%s'", l.Distribution))
+	}
+
+	return nil
+}
+
+// sample draws a delay in milliseconds
+func (l *Latency) sample(r *rand.Rand) float64 {
+	var ms float64
+	switch l.Distribution {
+	case UniformLatency:
+		ms = l.Min + r.Float64()*(l.Max-l.Min)
+	case NormalLatency:
+		ms = l.Mean + r.NormFloat64()*l.StdDev
+	case ExponentialLatency:
+		ms = r.ExpFloat64() * l.Mean
+	case LogNormalLatency:
+		ms = l.Median * math.Exp(r.NormFloat64()*l.Sigma)
+	case ParetoLatency:
+		// inverse transform sampling, 1 - Float64() is within (0, 1]
+		ms = l.Scale / math.Pow(1-r.Float64(), 1/l.Shape)
+	}
+
+	if ms < 0 {
+		ms = 0
+	}
+	if l.Cap > 0 && ms > l.Cap {
+		ms = l.Cap
+	}
+	return ms
+}
+
+// delayFor returns how long to hold a message matched by the given rule
+func (p *Plan) delayFor(rule *Rule) time.Duration {
+	delay := time.Duration(rule.Delay) * time.Millisecond
+	if rule.Latency != nil {
+		delay += time.Duration(rule.Latency.sample(p.random()) * float64(time.Millisecond))
+	}
+	return delay
+}
+
+// lockedSource makes a random source safe for concurrent use, as the connections of the proxy share it
+type lockedSource struct {
+	src rand.Source
+	m   sync.Mutex
+}
+
+func newRandom(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.src.Seed(seed)
+}
+
+// defaultRandom is used by plans with no seed
+var defaultRandom = newRandom(time.Now().UnixNano())
+
+// random returns the source of the random decisions of the plan, seeded by the seed of the plan if any
+func (p *Plan) random() *rand.Rand {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	if p.rand == nil {
+		return defaultRandom
+	}
+	return p.rand
+}
@@ -0,0 +1,84 @@
+package redfi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestLatencyValidate(t *testing.T) {
+	cases := []struct {
+		latency  Latency
+		expected bool
+	}{
+		{latency: Latency{Distribution: UniformLatency, Min: 10, Max: 20}, expected: true},
+		{latency: Latency{Distribution: UniformLatency, Min: 20, Max: 10}, expected: false},
+		{latency: Latency{Distribution: NormalLatency, Mean: 20, StdDev: 5}, expected: true},
+		{latency: Latency{Distribution: ExponentialLatency}, expected: false},
+		{latency: Latency{Distribution: LogNormalLatency, Median: 20, Sigma: 1}, expected: true},
+		{latency: Latency{Distribution: LogNormalLatency, Sigma: 1}, expected: false},
+		{latency: Latency{Distribution: ParetoLatency, Scale: 5, Shape: 1.5, Cap: 1000}, expected: true},
+		{latency: Latency{Distribution: ParetoLatency, Scale: 5, Shape: 1.5, Cap: -1}, expected: false},
+		{latency: Latency{Distribution: "gamma"}, expected: false},
+	}
+
+	for _, c := range cases {
+		err := c.latency.validate("latency")
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%+v:\n\texpected valid = %t\n\toutput         = %v", c.latency, c.expected, err))
+		}
+	}
+}
+
+func TestLatencySample(t *testing.T) {
+	cases := []struct {
+		latency Latency
+		// expected quantiles, within 10%
+		p50, p99 float64
+	}{
+		{latency: Latency{Distribution: UniformLatency, Min: 10, Max: 20}, p50: 15, p99: 19.9},
+		{latency: Latency{Distribution: NormalLatency, Mean: 100, StdDev: 10}, p50: 100, p99: 123.3},
+		{latency: Latency{Distribution: ExponentialLatency, Mean: 10}, p50: 6.93, p99: 46.05},
+		{latency: Latency{Distribution: LogNormalLatency, Median: 20, Sigma: 0.5}, p50: 20, p99: 63.9},
+		{latency: Latency{Distribution: ParetoLatency, Scale: 10, Shape: 2}, p50: 14.14, p99: 100},
+		{latency: Latency{Distribution: ParetoLatency, Scale: 10, Shape: 2, Cap: 50}, p50: 14.14, p99: 50},
+	}
+
+	for _, c := range cases {
+		r := newRandom(1)
+		samples := make([]float64, 100000)
+		for i := range samples {
+			samples[i] = c.latency.sample(r)
+		}
+		sort.Float64s(samples)
+
+		p50 := samples[len(samples)/2]
+		p99 := samples[len(samples)*99/100]
+		if math.Abs(p50-c.p50) > c.p50/10 || math.Abs(p99-c.p99) > c.p99/10 {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%+v:\n\texpected = p50 %.2f, p99 %.2f\n\toutput   = p50 %.2f, p99 %.2f", c.latency, c.p50, c.p99, p50, p99))
+		}
+		if c.latency.Cap > 0 && samples[len(samples)-1] > c.latency.Cap {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%+v:\n\tsample over the cap: %.2f", c.latency, samples[len(samples)-1]))
+		}
+	}
+}
+
+func TestDelayForSeed(t *testing.T) {
+	seed := int64(42)
+	rule := &Rule{Delay: 5, Latency: &Latency{Distribution: ExponentialLatency, Mean: 10}}
+
+	delays := func() string {
+		p := &Plan{Seed: &seed, rand: newRandom(seed)}
+		out := ""
+		for i := 0; i < 5; i++ {
+			out += fmt.Sprintf("%s ", p.delayFor(rule))
+		}
+		return out
+	}
+
+	first, second := delays(), delays()
+	if first != second {
+		t.Fatal(fmt.Sprintf("Case failed:\n\tseeded delays differ:\n\t%s\n\t%s", first, second))
+	}
+}
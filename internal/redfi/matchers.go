@@ -0,0 +1,194 @@
+package redfi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// Matcher holds match directives, which apply using a logical "and" like those of a rule.
+// Not, AnyOf and AllOf nest matchers to negate or combine them.
+type Matcher struct {
+	ClientAddr   string         `json:"clientAddr,omitempty"`
+	ClientName   string         `json:"clientName,omitempty"`
+	Command      string         `json:"command,omitempty"`
+	ConnectionID *NumberMatcher `json:"connectionId,omitempty"`
+	KeyPattern   string         `json:"keyPattern,omitempty"`
+	KeyPrefix    string         `json:"keyPrefix,omitempty"`
+	ArgCount     *NumberMatcher `json:"argCount,omitempty"`
+	Args         []ArgMatcher   `json:"args,omitempty"`
+	RawMatchAny  []string       `json:"rawMatchAny,omitempty"`
+	RawMatchAll  []string       `json:"rawMatchAll,omitempty"`
+	Shard        string         `json:"shard,omitempty"`
+	Slots        [][2]int       `json:"slots,omitempty"`
+
+	Not   *Matcher   `json:"not,omitempty"`
+	AnyOf []*Matcher `json:"anyOf,omitempty"`
+	AllOf []*Matcher `json:"allOf,omitempty"`
+}
+
+// matcher returns the match directives of a rule
+func (r *Rule) matcher() *Matcher {
+	return &Matcher{
+		ClientAddr:   r.ClientAddr,
+		ClientName:   r.ClientName,
+		Command:      r.Command,
+		ConnectionID: r.ConnectionID,
+		KeyPattern:   r.KeyPattern,
+		KeyPrefix:    r.KeyPrefix,
+		ArgCount:     r.ArgCount,
+		Args:         r.Args,
+		RawMatchAny:  r.RawMatchAny,
+		RawMatchAll:  r.RawMatchAll,
+		Shard:        r.Shard,
+		Slots:        r.Slots,
+		Not:          r.Not,
+		AnyOf:        r.AnyOf,
+		AllOf:        r.AllOf,
+	}
+}
+
+// isEmpty reports whether the matcher holds no directive, such a matcher never matches
+func (m *Matcher) isEmpty() bool {
+	return len(m.ClientAddr) == 0 && len(m.ClientName) == 0 && len(m.Command) == 0 && m.ConnectionID == nil &&
+		len(m.KeyPattern) == 0 && len(m.KeyPrefix) == 0 && m.ArgCount == nil && len(m.Args) == 0 &&
+		len(m.RawMatchAny) == 0 && len(m.RawMatchAll) == 0 && len(m.Shard) == 0 && len(m.Slots) == 0 &&
+		m.Not == nil && len(m.AnyOf) == 0 && len(m.AllOf) == 0
+}
+
+// validate checks a matcher and its nested matchers, and compiles their regexes
+func (m *Matcher) validate(ruleName string) error {
+	for i := range m.Args {
+		err := m.Args[i].compile()
+		if err != nil {
+			return fmt.Errorf("regex of argument matcher #%d in rule '%s' is malformed: %s", i, ruleName, err)
+		}
+	}
+
+	for _, slots := range m.Slots {
+		if slots[0] < 0 || slots[0] > slots[1] || slots[1] >= clusterSlots {
+			return fmt.Errorf("slots in rule '%s' are malformed, ranges must be within 0-%d", ruleName, clusterSlots-1)
+		}
+	}
+
+	nested := append([]*Matcher{m.Not}, m.AnyOf...)
+	nested = append(nested, m.AllOf...)
+	for _, sub := range nested {
+		if sub == nil {
+			continue
+		}
+		err := sub.validate(ruleName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NumberMatcher compares a number, every bound that is set must hold
+type NumberMatcher struct {
+	Eq  *float64 `json:"eq,omitempty"`
+	Ne  *float64 `json:"ne,omitempty"`
+	Gt  *float64 `json:"gt,omitempty"`
+	Gte *float64 `json:"gte,omitempty"`
+	Lt  *float64 `json:"lt,omitempty"`
+	Lte *float64 `json:"lte,omitempty"`
+}
+
+func (m *NumberMatcher) isSet() bool {
+	return m.Eq != nil || m.Ne != nil || m.Gt != nil || m.Gte != nil || m.Lt != nil || m.Lte != nil
+}
+
+func (m *NumberMatcher) matches(n float64) bool {
+	return (m.Eq == nil || n == *m.Eq) &&
+		(m.Ne == nil || n != *m.Ne) &&
+		(m.Gt == nil || n > *m.Gt) &&
+		(m.Gte == nil || n >= *m.Gte) &&
+		(m.Lt == nil || n < *m.Lt) &&
+		(m.Lte == nil || n <= *m.Lte)
+}
+
+// ArgMatcher matches a single argument of a command, every condition that is set must hold.
+// Index 0 is the command name, 1 the first argument, and negative indexes count from the end.
+type ArgMatcher struct {
+	Index  int    `json:"index"`
+	Equals string `json:"equals,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Glob   string `json:"glob,omitempty"`
+	// numeric comparisons, the argument doesn't match if it isn't a number
+	NumberMatcher
+
+	regex *regexp.Regexp
+}
+
+func (m *ArgMatcher) compile() error {
+	if len(m.Regex) == 0 {
+		return nil
+	}
+
+	regex, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return err
+	}
+	m.regex = regex
+	return nil
+}
+
+func (m *ArgMatcher) matches(args []redcon.RESP) bool {
+	idx := m.Index
+	if idx < 0 {
+		idx += len(args)
+	}
+	if idx < 0 || idx >= len(args) {
+		return false
+	}
+	arg := args[idx].Data
+
+	if len(m.Equals) > 0 && string(arg) != m.Equals {
+		return false
+	}
+
+	if len(m.Regex) > 0 {
+		if !m.regex.Match(arg) {
+			return false
+		}
+	}
+
+	if len(m.Glob) > 0 && !match.Match(string(arg), m.Glob) {
+		return false
+	}
+
+	if m.NumberMatcher.isSet() {
+		n, err := strconv.ParseFloat(string(arg), 64)
+		if err != nil || !m.NumberMatcher.matches(n) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesArgs evaluates the argument matchers against a request
+func matchesArgs(rule *Matcher, req redcon.RESP) bool {
+	args, err := respArrToSlice(req)
+	if err != nil || len(args) == 0 {
+		return false
+	}
+
+	// the command name isn't an argument
+	if rule.ArgCount != nil && !rule.ArgCount.matches(float64(len(args)-1)) {
+		return false
+	}
+
+	for i := range rule.Args {
+		if !rule.Args[i].matches(args) {
+			return false
+		}
+	}
+
+	return true
+}
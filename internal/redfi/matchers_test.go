@@ -0,0 +1,194 @@
+package redfi
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestSelectRuleArgs(t *testing.T) {
+	cases := []struct {
+		name     string
+		rule     string
+		command  string
+		expected bool
+	}{
+		{
+			name:     "argument count",
+			rule:     `{"argCount": {"gte": 3}}`,
+			command:  "SET a 1 EX 10",
+			expected: true,
+		},
+		{
+			name:     "argument count excludes the command",
+			rule:     `{"argCount": {"eq": 2}}`,
+			command:  "GET a",
+			expected: false,
+		},
+		{
+			name:     "exact argument",
+			rule:     `{"args": [{"index": 3, "equals": "EX"}]}`,
+			command:  "SET a 1 EX 10",
+			expected: true,
+		},
+		{
+			name:     "negative index counts from the end",
+			rule:     `{"args": [{"index": -1, "equals": "10"}]}`,
+			command:  "SET a 1 EX 10",
+			expected: true,
+		},
+		{
+			name:     "index out of range",
+			rule:     `{"args": [{"index": 5, "glob": "*"}]}`,
+			command:  "SET a 1",
+			expected: false,
+		},
+		{
+			name:     "regex",
+			rule:     `{"args": [{"index": 1, "regex": "^user:[0-9]+$"}]}`,
+			command:  "GET user:42",
+			expected: true,
+		},
+		{
+			name:     "glob",
+			rule:     `{"args": [{"index": 1, "glob": "session:*"}]}`,
+			command:  "GET user:42",
+			expected: false,
+		},
+		{
+			name:     "EXPIRE with ttl > 3600",
+			rule:     `{"command": "EXPIRE", "args": [{"index": 2, "gt": 3600}]}`,
+			command:  "EXPIRE a 7200",
+			expected: true,
+		},
+		{
+			name:     "EXPIRE with ttl <= 3600",
+			rule:     `{"command": "EXPIRE", "args": [{"index": 2, "gt": 3600}]}`,
+			command:  "EXPIRE a 60",
+			expected: false,
+		},
+		{
+			name:     "numeric comparison on a non number",
+			rule:     `{"args": [{"index": 1, "lt": 10}]}`,
+			command:  "GET a",
+			expected: false,
+		},
+		{
+			name:     "every matcher must hold",
+			rule:     `{"args": [{"index": 0, "equals": "SET"}, {"index": 2, "gte": 1, "lte": 5}]}`,
+			command:  "SET a 8",
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		rule := &Rule{}
+		err := json.Unmarshal([]byte(c.rule), rule)
+		if err == nil {
+			err = rule.validate()
+		}
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\terror = %s", c.name, err))
+		}
+
+		p := &Plan{RequestRules: []*Rule{rule}}
+		output := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{}, command(c.command), MakeLogger(-1))
+		if (output != nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected match = %t", c.name, c.expected))
+		}
+	}
+}
+
+func TestArgsMalformedRegex(t *testing.T) {
+	rule := &Rule{Name: "bad", Args: []ArgMatcher{{Index: 1, Regex: "("}}}
+	if rule.validate() == nil {
+		t.Fatal("expected an error for a malformed regex")
+	}
+}
+
+func TestSelectRuleComposition(t *testing.T) {
+	// every command except PING from clients other than the healthchecker
+	rule := `{
+		"not": {
+			"anyOf": [
+				{"command": "PING"},
+				{"clientName": "healthchecker"}
+			]
+		}
+	}`
+
+	cases := []struct {
+		name       string
+		rule       string
+		clientAddr string
+		command    string
+		expected   bool
+	}{
+		{name: "other command", rule: rule, clientAddr: "10.0.0.1:1000", command: "GET a", expected: true},
+		{name: "PING", rule: rule, clientAddr: "10.0.0.1:1000", command: "PING", expected: false},
+		{name: "healthchecker", rule: rule, clientAddr: "10.0.0.2:1000", command: "GET a", expected: false},
+		{
+			name:       "allOf with top level directives",
+			rule:       `{"command": "SET", "allOf": [{"keyPrefix": "user:"}, {"not": {"args": [{"index": 2, "equals": "1"}]}}]}`,
+			clientAddr: "10.0.0.1:1000",
+			command:    "SET user:1 2",
+			expected:   true,
+		},
+		{
+			name:       "allOf fails on one matcher",
+			rule:       `{"command": "SET", "allOf": [{"keyPrefix": "user:"}, {"not": {"args": [{"index": 2, "equals": "1"}]}}]}`,
+			clientAddr: "10.0.0.1:1000",
+			command:    "SET user:1 1",
+			expected:   false,
+		},
+		{
+			name:       "nested regex",
+			rule:       `{"anyOf": [{"args": [{"index": 1, "regex": "^session:"}]}, {"clientAddr": "10.0.0.9"}]}`,
+			clientAddr: "10.0.0.1:1000",
+			command:    "GET session:1",
+			expected:   true,
+		},
+	}
+
+	for _, c := range cases {
+		rule := &Rule{}
+		err := json.Unmarshal([]byte(c.rule), rule)
+		if err == nil {
+			err = rule.validate()
+		}
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\terror = %s", c.name, err))
+		}
+
+		p := &Plan{
+			RequestRules:  []*Rule{rule},
+			clientNameMap: map[string]string{"10.0.0.2:1000": "healthchecker"},
+		}
+		output := p.SelectRule("REQUEST", p.RequestRules, &ConnInfo{ClientAddr: c.clientAddr}, command(c.command), MakeLogger(-1))
+		if (output != nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected match = %t", c.name, c.expected))
+		}
+	}
+}
+
+func TestSelectRuleConnectionID(t *testing.T) {
+	rule := &Rule{Name: "every_connection_after_the_third", ConnectionID: &NumberMatcher{Gt: new(float64)}}
+	*rule.ConnectionID.Gt = 3
+
+	p := &Plan{ConnectionRules: []*Rule{rule}}
+	for id, expected := range []bool{false, false, false, false, true, true} {
+		output := p.SelectRule("CONNECTION", p.ConnectionRules, &ConnInfo{ID: uint64(id)}, redcon.RESP{}, MakeLogger(-1))
+		if (output != nil) != expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\tconnection #%d:\n\texpected match = %t", id, expected))
+		}
+	}
+}
+
+func TestNestedMalformedRegex(t *testing.T) {
+	rule := &Rule{Name: "bad", AnyOf: []*Matcher{{Not: &Matcher{Args: []ArgMatcher{{Index: 1, Regex: "("}}}}}}
+	if rule.validate() == nil {
+		t.Fatal("expected an error for a malformed regex in a nested matcher")
+	}
+}
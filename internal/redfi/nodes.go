@@ -0,0 +1,122 @@
+package redfi
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// nodeMap proxies Redis nodes that are discovered at runtime, each on its own listener,
+// so the addresses announced to clients always point back at the proxy
+type nodeMap struct {
+	proxy        *Proxy
+	listenHost   string
+	announceHost string
+	nextPort     int
+
+	// maps the address of a Redis node to the address clients use to reach it through the proxy
+	nodes     map[string]string
+	listeners map[string]net.Listener
+	m         sync.Mutex
+}
+
+// newNodeMap proxies nodes on the listen host and the ports following the listen port.
+// announceHost is the host given to clients in rewritten replies, it defaults to the listen host.
+// The redis address is proxied on the listen address itself.
+func newNodeMap(p *Proxy, announceHost string) (*nodeMap, error) {
+	if network, _ := splitAddr(p.listen); network != "tcp" {
+		return nil, fmt.Errorf("the listen address must be a TCP address to proxy other nodes")
+	}
+
+	host, portStr, err := net.SplitHostPort(p.listen)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(announceHost) == 0 {
+		announceHost = host
+	}
+
+	return &nodeMap{
+		proxy:        p,
+		listenHost:   host,
+		announceHost: announceHost,
+		nextPort:     port + 1,
+		nodes: map[string]string{
+			p.redisAddr: net.JoinHostPort(announceHost, portStr),
+		},
+		listeners: map[string]net.Listener{},
+	}, nil
+}
+
+// proxyAddr returns the address clients should use to reach the given node,
+// starting a listener for it if the node wasn't known yet
+func (n *nodeMap) proxyAddr(upstreamAddr string, logger Logger) string {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if addr, ok := n.nodes[upstreamAddr]; ok {
+		return addr
+	}
+
+	return n.listen(upstreamAddr, logger)
+}
+
+// move proxies the given node on a fresh listener and stops the previous one,
+// it returns the previous and the new address clients use to reach the node
+func (n *nodeMap) move(upstreamAddr string, logger Logger) (string, string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	prev, ok := n.nodes[upstreamAddr]
+	if ln, ok := n.listeners[upstreamAddr]; ok {
+		ln.Close()
+		delete(n.listeners, upstreamAddr)
+	}
+	delete(n.nodes, upstreamAddr)
+
+	addr := n.listen(upstreamAddr, logger)
+	if !ok {
+		prev = addr
+	}
+	return prev, addr
+}
+
+// listen starts a listener for the given node, n.m must be held
+func (n *nodeMap) listen(upstreamAddr string, logger Logger) string {
+	port := strconv.Itoa(n.nextPort)
+	n.nextPort++
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(n.listenHost, port))
+	if err != nil {
+		log.Println("failed to start a listener for node", upstreamAddr, err)
+		return upstreamAddr
+	}
+
+	addr := net.JoinHostPort(n.announceHost, port)
+	n.nodes[upstreamAddr] = addr
+	n.listeners[upstreamAddr] = ln
+	logger(0, fmt.Sprintf("Proxying node %s on %s\n", upstreamAddr, ln.Addr()))
+
+	go n.proxy.serve(ln, upstreamAddr, logger)
+	return addr
+}
+
+// resolve fills in the host of a node address announced without one,
+// which Redis uses to mean the host of the node that sent the reply
+func resolve(addr string, upstreamHost string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if len(host) == 0 || host == "?" {
+		host = upstreamHost
+	}
+	return net.JoinHostPort(host, port)
+}
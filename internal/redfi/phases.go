@@ -0,0 +1,303 @@
+package redfi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// how often the exit condition of the current phase is checked
+var phasePollInterval = 10 * time.Millisecond
+
+// ErrNoSignal is returned when signaling a phase that doesn't wait for a signal
+var ErrNoSignal = errors.New("the current phase doesn't wait for a signal")
+
+// Phase is a step of a scenario, with its own rules, that lasts until its exit condition is met.
+// The rules of the phase apply before the rules at the top of the plan.
+type Phase struct {
+	Name            string     `json:"name,omitempty"`
+	RequestRules    []*Rule    `json:"requestRules,omitempty"`
+	ResponseRules   []*Rule    `json:"responseRules,omitempty"`
+	PushRules       []*Rule    `json:"pushRules,omitempty"`
+	TLSRules        []*Rule    `json:"tlsRules,omitempty"`
+	ConnectionRules []*Rule    `json:"connectionRules,omitempty"`
+	Until           *PhaseExit `json:"until,omitempty"`
+}
+
+// PhaseExit ends a phase as soon as any of its conditions is met, a phase without one lasts forever
+type PhaseExit struct {
+	// milliseconds since the phase started
+	Elapsed int `json:"elapsed,omitempty"`
+	// times the rule with the given name was applied during the phase
+	Rule string `json:"rule,omitempty"`
+	Hits uint64 `json:"hits,omitempty"`
+	// a signal sent through the control API
+	Signal bool `json:"signal,omitempty"`
+}
+
+// PhaseState is where a scenario is at
+type PhaseState struct {
+	// index of the current phase, the number of phases once the last one ended
+	Index  int    `json:"index"`
+	Name   string `json:"name,omitempty"`
+	Phases int    `json:"phases"`
+	// milliseconds since the current phase started
+	Elapsed  int64 `json:"elapsed"`
+	Finished bool  `json:"finished"`
+}
+
+func (ph *Phase) rules(kind string) []*Rule {
+	rules := ph.rulesFor(kind)
+	if rules == nil {
+		return nil
+	}
+	return *rules
+}
+
+// rulesFor returns the rule list of the phase for the given kind, nil for an unknown kind
+func (ph *Phase) rulesFor(kind string) *[]*Rule {
+	switch kind {
+	case RequestStream:
+		return &ph.RequestRules
+	case ResponseStream:
+		return &ph.ResponseRules
+	case PushStream:
+		return &ph.PushRules
+	case TLSStream:
+		return &ph.TLSRules
+	case ConnectionStream:
+		return &ph.ConnectionRules
+	}
+	return nil
+}
+
+// validatePhases checks the phases of a parsed plan and enters the first one
+func (p *Plan) validatePhases() error {
+	p.common = map[string][]*Rule{}
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		p.common[kind] = *rules
+	}
+
+	for i, phase := range p.Phases {
+		if len(phase.Name) == 0 {
+			phase.Name = fmt.Sprintf("phase %d", i+1)
+		}
+
+		names := map[string]bool{}
+		for _, kind := range ruleKinds {
+			for j, rule := range phase.rules(kind) {
+				err := rule.validateFor(kind)
+				if err != nil {
+					return fmt.Errorf("encountered error when adding %s rule #%d of phase '%s': %s", kind, j, phase.Name, err)
+				}
+				names[rule.Name] = true
+			}
+			for _, rule := range p.common[kind] {
+				names[rule.Name] = true
+			}
+		}
+
+		until := phase.Until
+		if until == nil {
+			continue
+		}
+		if until.Elapsed < 0 {
+			return fmt.Errorf("until of phase '%s' is malformed, elapsed can't be negative", phase.Name)
+		}
+		if (len(until.Rule) > 0) != (until.Hits > 0) {
+			return fmt.Errorf("until of phase '%s' is malformed, set both rule and hits", phase.Name)
+		}
+		if len(until.Rule) > 0 && !names[until.Rule] {
+			return fmt.Errorf("until of phase '%s' is malformed, no rule named '%s' applies during the phase", phase.Name, until.Rule)
+		}
+	}
+
+	p.enterPhase(0)
+	return nil
+}
+
+// enterPhase swaps in the rules of the phase at index i, callers must hold p.m
+func (p *Plan) enterPhase(i int) {
+	p.phase = i
+	p.phaseStart = time.Now()
+	p.signaled = false
+
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		next := []*Rule{}
+		if i < len(p.Phases) {
+			next = append(next, p.Phases[i].rules(kind)...)
+		}
+		*rules = append(next, p.common[kind]...)
+	}
+
+	p.phaseRule, p.phaseHits = p.phaseExitRule(), 0
+	if p.phaseRule != nil {
+		p.phaseHits = atomic.LoadUint64(&p.phaseRule.hits)
+	}
+}
+
+// keepEdit carries an edit of the current rules through the control API over to the rules of the current phase,
+// or to the rules at the top of the plan, so that it outlasts phase changes.
+// idx is the position of the edited rule in the current rules, -1 for an added rule, and rule is nil for a deleted one.
+// Callers must hold p.m.
+func (p *Plan) keepEdit(kind string, idx int, rule *Rule) {
+	if len(p.Phases) == 0 {
+		return
+	}
+	kind = strings.ToLower(kind)
+
+	// the current rules are the rules of the phase followed by the rules at the top of the plan
+	phaseRules := &[]*Rule{}
+	if p.phase < len(p.Phases) {
+		phaseRules = p.Phases[p.phase].rulesFor(kind)
+	}
+	common := p.common[kind]
+
+	rules := phaseRules
+	if idx < 0 || idx >= len(*phaseRules) {
+		// added rules apply in every phase
+		rules = &common
+		if idx >= 0 {
+			idx -= len(*phaseRules)
+		}
+	}
+
+	// copy on write, the rules may be shared with the current rules
+	updated := append([]*Rule{}, *rules...)
+	switch {
+	case idx < 0:
+		updated = append(updated, rule)
+	case rule == nil:
+		updated = append(updated[:idx], updated[idx+1:]...)
+	default:
+		updated[idx] = rule
+	}
+	*rules = updated
+	p.common[kind] = common
+}
+
+// phaseExitRule returns the rule the exit condition of the current phase counts the hits of, callers must hold p.m, for reading at least
+func (p *Plan) phaseExitRule() *Rule {
+	if p.phase >= len(p.Phases) || p.Phases[p.phase].Until == nil || len(p.Phases[p.phase].Until.Rule) == 0 {
+		return nil
+	}
+
+	name := p.Phases[p.phase].Until.Rule
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		for _, rule := range *rules {
+			if rule.Name == name {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// phaseRuleHits returns the hits of the exit rule of the current phase since the phase started, callers must hold p.m, for reading at least
+func (p *Plan) phaseRuleHits(rule *Rule) uint64 {
+	hits := atomic.LoadUint64(&rule.hits)
+	if rule != p.phaseRule || hits < p.phaseHits {
+		// the rule was replaced through the control API during the phase, the new one counts from zero
+		return hits
+	}
+	return hits - p.phaseHits
+}
+
+// phaseOver returns why the current phase is over, or an empty string if it isn't. Callers must hold p.m, for reading at least.
+func (p *Plan) phaseOver() string {
+	if p.phase >= len(p.Phases) || p.Phases[p.phase].Until == nil {
+		return ""
+	}
+	until := p.Phases[p.phase].Until
+
+	if until.Elapsed > 0 && time.Since(p.phaseStart) >= time.Duration(until.Elapsed)*time.Millisecond {
+		return fmt.Sprintf("%dms elapsed", until.Elapsed)
+	}
+	if rule := p.phaseExitRule(); rule != nil && p.phaseRuleHits(rule) >= until.Hits {
+		return fmt.Sprintf("rule '%s' applied %d times", rule.Name, until.Hits)
+	}
+	if until.Signal && p.signaled {
+		return "signaled"
+	}
+	return ""
+}
+
+// advancePhase moves on to the next phase if the current one is over
+func (p *Plan) advancePhase(logger Logger) {
+	// checked under the read lock first, the write lock holds up every proxied message
+	p.m.RLock()
+	over := len(p.phaseOver()) > 0
+	p.m.RUnlock()
+	if !over {
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	// the phase may have changed in the meantime
+	reason := p.phaseOver()
+	if len(reason) == 0 {
+		return
+	}
+
+	prev := p.Phases[p.phase].Name
+	p.enterPhase(p.phase + 1)
+	if p.phase < len(p.Phases) {
+		logger(0, fmt.Sprintf("Phase '%s' over (%s), entering phase %d/%d '%s'\n", prev, reason, p.phase+1, len(p.Phases), p.Phases[p.phase].Name))
+	} else {
+		logger(0, fmt.Sprintf("Phase '%s' over (%s), scenario finished\n", prev, reason))
+	}
+}
+
+// SignalPhase ends the current phase if it waits for a signal
+func (p *Plan) SignalPhase() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if p.phase >= len(p.Phases) || p.Phases[p.phase].Until == nil || !p.Phases[p.phase].Until.Signal {
+		return ErrNoSignal
+	}
+	p.signaled = true
+	return nil
+}
+
+// PhaseState returns where the scenario of the plan is at
+func (p *Plan) PhaseState() PhaseState {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	state := PhaseState{
+		Index:    p.phase,
+		Phases:   len(p.Phases),
+		Finished: p.phase >= len(p.Phases),
+	}
+	if len(p.Phases) > 0 {
+		state.Elapsed = int64(time.Since(p.phaseStart) / time.Millisecond)
+	}
+	if !state.Finished {
+		state.Name = p.Phases[p.phase].Name
+	}
+	return state
+}
+
+// RunPhases advances through the phases of the plan as their exit conditions are met.
+// It blocks forever, so it's meant to be run in its own goroutine.
+func (p *Proxy) RunPhases(logger Logger) {
+	state := p.plan.PhaseState()
+	if state.Phases > 0 {
+		logger(0, fmt.Sprintf("Entering phase 1/%d '%s'\n", state.Phases, state.Name))
+	}
+
+	ticker := time.NewTicker(phasePollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.plan.advancePhase(logger)
+	}
+}
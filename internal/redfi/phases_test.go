@@ -0,0 +1,244 @@
+package redfi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parsePlan parses a plan given as JSON
+func parsePlan(t *testing.T, plan string) (*Plan, error) {
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	err := os.WriteFile(planPath, []byte(plan), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Parse(planPath)
+}
+
+func TestPhases(t *testing.T) {
+	p, err := parsePlan(t, `{
+		"requestRules": [{"name": "common", "alwaysMatch": true}],
+		"phases": [
+			{"name": "healthy", "until": {"elapsed": 50}},
+			{
+				"name": "outage",
+				"requestRules": [{"name": "loading", "alwaysMatch": true, "error": "LOADING"}],
+				"until": {"rule": "loading", "hits": 2}
+			},
+			{"until": {"signal": true}}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := MakeLogger(-1)
+	selected := func() string {
+		rule := p.SelectRule("REQUEST", p.Rules(RequestStream), &ConnInfo{}, command("GET a"), logger)
+		if rule == nil {
+			return ""
+		}
+		return rule.Name
+	}
+	expectPhase := func(step string, index int, name string, rule string) {
+		state := p.PhaseState()
+		output := selected()
+		if state.Index != index || state.Name != name || output != rule {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = phase #%d '%s', rule '%s'\n\toutput   = phase #%d '%s', rule '%s'", step, index, name, rule, state.Index, state.Name, output))
+		}
+	}
+
+	expectPhase("start", 0, "healthy", "common")
+	p.advancePhase(logger)
+	expectPhase("before elapsed", 0, "healthy", "common")
+	if p.SignalPhase() != ErrNoSignal {
+		t.Fatal("phase that doesn't wait for a signal was signaled")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	p.advancePhase(logger)
+	expectPhase("elapsed", 1, "outage", "loading")
+	p.advancePhase(logger)
+	expectPhase("before hits", 1, "outage", "loading")
+
+	// unnamed phases are named after their position
+	p.advancePhase(logger)
+	expectPhase("hits", 2, "phase 3", "common")
+	p.advancePhase(logger)
+	expectPhase("before signal", 2, "phase 3", "common")
+
+	err = p.SignalPhase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.advancePhase(logger)
+	state := p.PhaseState()
+	if !state.Finished || state.Index != 3 || selected() != "common" {
+		t.Fatalf("scenario didn't finish: %+v", state)
+	}
+}
+
+func TestPhasesMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		plan string
+	}{
+		{name: "unknown rule", plan: `{"phases": [{"until": {"rule": "missing", "hits": 1}}]}`},
+		{name: "rule of another phase", plan: `{"phases": [{"until": {"rule": "later", "hits": 1}}, {"requestRules": [{"name": "later"}]}]}`},
+		{name: "hits without rule", plan: `{"phases": [{"until": {"hits": 1}}]}`},
+		{name: "rule without hits", plan: `{"requestRules": [{"name": "common"}], "phases": [{"until": {"rule": "common"}}]}`},
+		{name: "negative elapsed", plan: `{"phases": [{"until": {"elapsed": -1}}]}`},
+		{name: "malformed rule", plan: `{"phases": [{"requestRules": [{"name": "bad", "percentage": 101}]}]}`},
+	}
+
+	for _, c := range cases {
+		_, err := parsePlan(t, c.plan)
+		if err == nil {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected an error", c.name))
+		}
+	}
+
+	// rules at the top of the plan apply in every phase
+	_, err := parsePlan(t, `{"requestRules": [{"name": "common"}], "phases": [{"until": {"rule": "common", "hits": 1}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPhasesExitRuleReplaced(t *testing.T) {
+	p, err := parsePlan(t, `{
+		"phases": [
+			{
+				"name": "outage",
+				"requestRules": [{"name": "loading", "alwaysMatch": true, "error": "LOADING"}],
+				"until": {"rule": "loading", "hits": 3}
+			},
+			{"name": "recovery"}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := MakeLogger(-1)
+	apply := func(n int) {
+		for i := 0; i < n; i++ {
+			p.SelectRule("REQUEST", p.Rules(RequestStream), &ConnInfo{}, command("GET a"), logger)
+		}
+	}
+
+	apply(2)
+	err = p.UpdateRule(RequestStream, "loading", Rule{AlwaysMatch: true, Error: "BUSY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replacement counts its own hits from zero
+	p.advancePhase(logger)
+	if state := p.PhaseState(); state.Name != "outage" {
+		t.Fatalf("phase ended when its exit rule was replaced: %+v", state)
+	}
+	apply(2)
+	p.advancePhase(logger)
+	if state := p.PhaseState(); state.Name != "outage" {
+		t.Fatalf("phase ended before the replaced exit rule reached its hits: %+v", state)
+	}
+	apply(1)
+	p.advancePhase(logger)
+	if state := p.PhaseState(); state.Name != "recovery" {
+		t.Fatalf("phase didn't end once the replaced exit rule reached its hits: %+v", state)
+	}
+}
+
+func TestAdvancePhaseReadLock(t *testing.T) {
+	for _, plan := range []string{`{}`, `{"phases": [{"until": {"signal": true}}]}`} {
+		p, err := parsePlan(t, plan)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a phase that isn't over doesn't wait for the write lock, proxied messages hold the read lock
+		p.m.RLock()
+		done := make(chan struct{})
+		go func() {
+			p.advancePhase(MakeLogger(-1))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\tadvancePhase waited for the write lock", plan))
+		}
+		p.m.RUnlock()
+	}
+}
+
+func TestPhasesKeepAPIEdits(t *testing.T) {
+	p, err := parsePlan(t, `{
+		"requestRules": [{"name": "common", "alwaysMatch": true}],
+		"phases": [
+			{"requestRules": [{"name": "first", "command": "GET"}], "until": {"signal": true}},
+			{"requestRules": [{"name": "second", "command": "GET"}, {"name": "third", "command": "SET"}], "until": {"signal": true}}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := MakeLogger(-1)
+	rules := func() string {
+		out := []string{}
+		for _, rule := range p.Rules(RequestStream) {
+			out = append(out, fmt.Sprintf("%s:%d", rule.Name, rule.Delay))
+		}
+		return strings.Join(out, " ")
+	}
+	next := func() {
+		err := p.SignalPhase()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.advancePhase(logger)
+	}
+	expect := func(step, expected string) {
+		if output := rules(); output != expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %s\n\toutput   = %s", step, expected, output))
+		}
+	}
+
+	for _, err := range []error{
+		p.UpdateRule(RequestStream, "first", Rule{Command: "GET", Delay: 1}),
+		p.UpdateRule(RequestStream, "common", Rule{AlwaysMatch: true, Delay: 2}),
+		p.AddRule(RequestStream, Rule{Name: "added", AlwaysMatch: true, Delay: 3}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("edited first phase", "first:1 common:2 added:3")
+
+	// edits of the rules at the top of the plan and added rules outlast the phase
+	next()
+	expect("second phase", "second:0 third:0 common:2 added:3")
+
+	for _, err := range []error{
+		p.DeleteRule(RequestStream, "second"),
+		p.UpdateRule(RequestStream, "third", Rule{Command: "SET", Delay: 4}),
+		p.DeleteRule(RequestStream, "added"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("edited second phase", "third:4 common:2")
+	if output := fmt.Sprintf("%s:%d", p.Phases[0].RequestRules[0].Name, p.Phases[0].RequestRules[0].Delay); output != "first:1" {
+		t.Fatalf("edit of the first phase wasn't kept: %s", output)
+	}
+
+	next()
+	expect("scenario finished", "common:2")
+}
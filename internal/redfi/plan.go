@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unicode"
 
 	"github.com/tidwall/redcon"
@@ -22,13 +23,53 @@ var (
 	ErrNotFound = errors.New("no matching rule found")
 )
 
+const (
+	// RequestStream names the rules applied to messages going from the client to the server
+	RequestStream = "request"
+	// ResponseStream names the rules applied to messages going from the server to the client
+	ResponseStream = "response"
+	// PushStream names the rules applied to RESP3 push messages going from the server to the client
+	PushStream = "push"
+	// TLSStream names the rules applied to TLS handshakes with clients
+	TLSStream = "tls"
+	// ConnectionStream names the rules applied to new client connections, before Redis is dialed
+	ConnectionStream = "connection"
+)
+
+// ruleKinds lists every kind of rule a plan holds
+var ruleKinds = []string{RequestStream, ResponseStream, PushStream, TLSStream, ConnectionStream}
+
 // Plan defines a set of rules to be applied by the proxy
 type Plan struct {
 	// MsgOrdering   string  `json:"msgOrdering,omitempty"`
-	RequestRules  []*Rule `json:"requestRules,omitempty"`
-	ResponseRules []*Rule `json:"responseRules,omitempty"`
-	// a lookup table mapping rule name to index in the array
-	rulesMap map[string]int
+	RequestRules    []*Rule `json:"requestRules,omitempty"`
+	ResponseRules   []*Rule `json:"responseRules,omitempty"`
+	PushRules       []*Rule `json:"pushRules,omitempty"`
+	TLSRules        []*Rule `json:"tlsRules,omitempty"`
+	ConnectionRules []*Rule `json:"connectionRules,omitempty"`
+	// steps of a scenario, each with its own rules, see phases.go
+	Phases []*Phase `json:"phases,omitempty"`
+	// makes random decisions, such as percentages and latencies, reproducible when set
+	Seed *int64 `json:"seed,omitempty"`
+	// what scheduled rules are timed from, ScheduleFromStart by default, see schedule.go
+	ScheduleFrom string `json:"scheduleFrom,omitempty"`
+
+	rand *rand.Rand
+	// when the schedule of the rules started, zero until triggered
+	epoch time.Time
+	// the rules at the top of the plan, which apply in every phase
+	common map[string][]*Rule
+	// index of the current phase, when it started, its exit rule and the hits of the rule by then,
+	// and whether it was signaled through the control API
+	phase      int
+	phaseStart time.Time
+	phaseRule  *Rule
+	phaseHits  uint64
+	signaled   bool
+	// bandwidth of the rules shared across connections
+	throttles map[*Rule]*throttle
+	// connections held by a blackhole, see blackhole.go
+	blackholes map[*session]*ActiveBlackhole
 
 	// a lookup table mapping network addresses to known client names
 	clientNameMap map[string]string
@@ -43,18 +84,76 @@ type Rule struct {
 	Drop        bool   `json:"drop,omitempty"`
 	ReturnEmpty bool   `json:"returnEmpty,omitempty"`
 	ReturnErr   string `json:"returnErr,omitempty"`
+	Error       string `json:"error,omitempty"` // name of an error real Redis answers with, see errors.go
 	Percentage  int    `json:"percentage,omitempty"`
 	Log         bool   `json:"log,omitempty"`
 
+	// random delay added to Delay, see latency.go
+	Latency *Latency `json:"latency,omitempty"`
+	// bytes per second, for each connection unless BandwidthScope is "shared"
+	Bandwidth      int    `json:"bandwidth,omitempty"`
+	BandwidthScope string `json:"bandwidthScope,omitempty"`
+	// deliver part of the message, or in many small writes, see delivery.go
+	Truncate *Truncate `json:"truncate,omitempty"`
+	Fragment *Fragment `json:"fragment,omitempty"`
+	// response and push rules only, mutates the bulk strings of the reply, see corrupt.go
+	Corrupt *Corrupt `json:"corrupt,omitempty"`
+	// answers with this value instead of Redis, see reply.go
+	Reply *ReplyValue `json:"reply,omitempty"`
+	// stops forwarding on the connection while keeping it open, see blackhole.go
+	Blackhole *Blackhole `json:"blackhole,omitempty"`
+	// tears down the connection, drop being a graceful close of the client, see disconnect.go
+	Disconnect *Disconnect `json:"disconnect,omitempty"`
+	// sentinel mode only, simulates a failover of the master with this name
+	Failover string `json:"failover,omitempty"`
+	// TLS rules only, aborts the handshake with a handshake_failure alert
+	HandshakeFail bool `json:"handshakeFail,omitempty"`
+	// connection rules only, fails to dial Redis, see connection.go
+	DialFail *DialFail `json:"dialFail,omitempty"`
+
 	// SelectRule does prefix matching on this value
-	ClientAddr  string   `json:"clientAddr,omitempty"`
-	ClientName  string   `json:"clientName,omitempty"`
-	Command     string   `json:"command,omitempty"`
+	ClientAddr string `json:"clientAddr,omitempty"`
+	ClientName string `json:"clientName,omitempty"`
+	Command    string `json:"command,omitempty"`
+	// ConnectionID is compared to the ordinal of the connection, the first one accepted being 1
+	ConnectionID *NumberMatcher `json:"connectionId,omitempty"`
+	// matched against the key arguments of the command, KeyPattern is a glob
+	KeyPattern string `json:"keyPattern,omitempty"`
+	KeyPrefix  string `json:"keyPrefix,omitempty"`
+	// ArgCount is compared to the number of arguments, the command name excluded
+	ArgCount *NumberMatcher `json:"argCount,omitempty"`
+	Args     []ArgMatcher   `json:"args,omitempty"`
+
 	RawMatchAny []string `json:"rawMatchAny,omitempty"`
 	RawMatchAll []string `json:"rawMatchAll,omitempty"`
 	AlwaysMatch bool     `json:"alwaysMatch,omitempty"`
 
-	hits uint64
+	// cluster mode only, Shard does prefix matching on the address of the Redis node
+	// and Slots holds inclusive [start, end] ranges of hash slots
+	Shard string   `json:"shard,omitempty"`
+	Slots [][2]int `json:"slots,omitempty"`
+
+	// nested matchers, combined with the other match directives
+	Not   *Matcher   `json:"not,omitempty"`
+	AnyOf []*Matcher `json:"anyOf,omitempty"`
+	AllOf []*Matcher `json:"allOf,omitempty"`
+
+	// expression that must hold for the rule to match, see expr.go
+	When string `json:"when,omitempty"`
+
+	// milliseconds into the schedule the rule becomes active, then stays active, see schedule.go
+	StartAfter int       `json:"startAfter,omitempty"`
+	Duration   int       `json:"duration,omitempty"`
+	Schedule   *Schedule `json:"schedule,omitempty"`
+
+	// limits on the matches the rule applies to, counted since the last reset through the control API, see counters.go
+	MaxHits   int `json:"maxHits,omitempty"`
+	SkipFirst int `json:"skipFirst,omitempty"`
+	EveryNth  int `json:"everyNth,omitempty"`
+
+	when    exprNode
+	hits    uint64
+	matched uint64
 }
 
 func (r Rule) String() string {
@@ -68,18 +167,87 @@ func (r Rule) String() string {
 	if r.Delay > 0 {
 		buf = append(buf, fmt.Sprintf("delay=%d", r.Delay))
 	}
+	if r.Latency != nil {
+		buf = append(buf, fmt.Sprintf("latency=%s", r.Latency.Distribution))
+	}
+	if r.Bandwidth > 0 {
+		buf = append(buf, fmt.Sprintf("bandwidth=%d", r.Bandwidth))
+	}
+	if r.Truncate != nil {
+		buf = append(buf, "truncate")
+	}
+	if r.Fragment != nil {
+		buf = append(buf, "fragment")
+	}
+	if r.Corrupt != nil {
+		buf = append(buf, fmt.Sprintf("corrupt=%s", r.Corrupt.Mode))
+	}
+	if r.Reply != nil {
+		buf = append(buf, fmt.Sprintf("reply=%s", r.Reply.Type))
+	}
+	if r.Blackhole != nil {
+		buf = append(buf, "blackhole")
+	}
 	if r.Drop {
 		buf = append(buf, fmt.Sprintf("drop=%t", r.Drop))
 	}
+	if r.Disconnect != nil {
+		buf = append(buf, "disconnect")
+	}
+	if r.DialFail != nil {
+		buf = append(buf, fmt.Sprintf("dialFail=%dms", r.DialFail.Timeout))
+	}
+	if r.StartAfter > 0 {
+		buf = append(buf, fmt.Sprintf("startAfter=%dms", r.StartAfter))
+	}
+	if r.Duration > 0 {
+		buf = append(buf, fmt.Sprintf("duration=%dms", r.Duration))
+	}
+	if r.Schedule != nil {
+		buf = append(buf, fmt.Sprintf("schedule=%dms/%dms", r.Schedule.On, r.Schedule.Off))
+	}
+	if r.MaxHits > 0 {
+		buf = append(buf, fmt.Sprintf("maxHits=%d", r.MaxHits))
+	}
+	if r.SkipFirst > 0 {
+		buf = append(buf, fmt.Sprintf("skipFirst=%d", r.SkipFirst))
+	}
+	if r.EveryNth > 0 {
+		buf = append(buf, fmt.Sprintf("everyNth=%d", r.EveryNth))
+	}
 	if r.ReturnEmpty {
 		buf = append(buf, fmt.Sprintf("returnEmpty=%t", r.ReturnEmpty))
 	}
 	if len(r.ReturnErr) > 0 {
 		buf = append(buf, fmt.Sprintf("returnErr=%s", r.ReturnErr))
 	}
+	if len(r.Error) > 0 {
+		buf = append(buf, fmt.Sprintf("error=%s", r.Error))
+	}
+	if len(r.Failover) > 0 {
+		buf = append(buf, fmt.Sprintf("failover=%s", r.Failover))
+	}
+	if r.HandshakeFail {
+		buf = append(buf, fmt.Sprintf("handshakeFail=%t", r.HandshakeFail))
+	}
 	if len(r.ClientAddr) > 0 {
 		buf = append(buf, fmt.Sprintf("clientAddr=%s", r.ClientAddr))
 	}
+	if len(r.KeyPattern) > 0 {
+		buf = append(buf, fmt.Sprintf("keyPattern=%s", r.KeyPattern))
+	}
+	if len(r.KeyPrefix) > 0 {
+		buf = append(buf, fmt.Sprintf("keyPrefix=%s", r.KeyPrefix))
+	}
+	if len(r.Args) > 0 {
+		buf = append(buf, fmt.Sprintf("args=%d", len(r.Args)))
+	}
+	if len(r.When) > 0 {
+		buf = append(buf, fmt.Sprintf("when=%s", r.When))
+	}
+	if len(r.Shard) > 0 {
+		buf = append(buf, fmt.Sprintf("shard=%s", r.Shard))
+	}
 	if r.Percentage > 0 {
 		buf = append(buf, fmt.Sprintf("percentage=%d", r.Percentage))
 	}
@@ -98,6 +266,7 @@ func Parse(planPath string) (*Plan, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer fd.Close()
 
 	buf, err := io.ReadAll(fd)
 	if err != nil {
@@ -106,7 +275,6 @@ func Parse(planPath string) (*Plan, error) {
 
 	// this is the plan we will use
 	plan := &Plan{
-		rulesMap:      map[string]int{},
 		clientNameMap: map[string]string{},
 	}
 
@@ -118,12 +286,34 @@ func Parse(planPath string) (*Plan, error) {
 		return nil, err
 	}
 
-	// for i, rule := range plan.RequestRules {
-	// 	err := plan.AddRuleMeta(*rule)
-	// 	if err != nil {
-	// 		return plan, fmt.Errorf("encountered error when adding rule #%d: %s", i, err)
-	// 	}
-	// }
+	if plan.Seed != nil {
+		plan.rand = newRandom(*plan.Seed)
+	}
+
+	if len(plan.Phases) > 0 {
+		err = plan.validatePhases()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch plan.ScheduleFrom {
+	case "", ScheduleFromStart:
+		plan.epoch = time.Now()
+	case ScheduleFromTrigger:
+	default:
+		return nil, fmt.Errorf("scheduleFrom is malformed, it must be '%s' or '%s'", ScheduleFromStart, ScheduleFromTrigger)
+	}
+
+	for _, kind := range ruleKinds {
+		rules, _ := plan.rulesFor(kind)
+		for i, rule := range *rules {
+			err := rule.validateFor(kind)
+			if err != nil {
+				return nil, fmt.Errorf("encountered error when adding %s rule #%d: %s", kind, i, err)
+			}
+		}
+	}
 
 	return plan, nil
 }
@@ -131,9 +321,13 @@ func Parse(planPath string) (*Plan, error) {
 func NewPlan() *Plan {
 	return &Plan{
 		// MsgOrdering:   "ordered",
-		RequestRules:  []*Rule{},
-		ResponseRules: []*Rule{},
-		rulesMap:      map[string]int{},
+		RequestRules:    []*Rule{},
+		ResponseRules:   []*Rule{},
+		PushRules:       []*Rule{},
+		TLSRules:        []*Rule{},
+		ConnectionRules: []*Rule{},
+		clientNameMap:   map[string]string{},
+		epoch:           time.Now(),
 	}
 }
 
@@ -143,7 +337,7 @@ func respArrToSlice(resp redcon.RESP) ([]redcon.RESP, error) {
 	}
 
 	out := make([]redcon.RESP, 0)
-	resp.ForEach(func(r redcon.RESP) bool {
+	forEachRESP(resp, func(r redcon.RESP) bool {
 		out = append(out, r)
 		return true
 	})
@@ -160,81 +354,209 @@ func (p *Plan) handleClientSetName(clientAddr string, resp redcon.RESP) {
 		return
 	}
 
-	if len(respSlice) != 3 {
-		return
+	name, ok := "", false
+	if len(respSlice) == 3 && rlower(respSlice[0]) == "client" && rlower(respSlice[1]) == "setname" {
+		name, ok = string(respSlice[2].Data), true
+	}
+
+	// RESP3 clients usually set their name during the handshake: HELLO 3 ... SETNAME name
+	if len(respSlice) > 0 && rlower(respSlice[0]) == "hello" {
+		for i := 1; i < len(respSlice)-1; i++ {
+			if rlower(respSlice[i]) == "setname" {
+				name, ok = string(respSlice[i+1].Data), true
+			}
+		}
 	}
 
-	if rlower(respSlice[0]) != "client" || rlower(respSlice[1]) != "setname" {
+	if !ok {
 		return
 	}
 
 	p.m.Lock()
-	p.clientNameMap[clientAddr] = string(respSlice[2].Data)
+	p.clientNameMap[clientAddr] = name
+	p.m.Unlock()
+}
+
+// forgetClient drops what is known about a client once its connection is closed
+func (p *Plan) forgetClient(clientAddr string) {
+	p.m.Lock()
+	delete(p.clientNameMap, clientAddr)
 	p.m.Unlock()
 }
 
-func (p *Plan) pickRule(rules []*Rule, clientAddr string, msg redcon.RESP, log Logger) *Rule {
+func (p *Plan) pickRule(streamType string, rules []*Rule, conn *ConnInfo, msg redcon.RESP, log Logger) *Rule {
+	clientAddr := conn.ClientAddr
 	for _, rule := range rules {
 		log(3, fmt.Sprintf("Checking rule: rule = %s, client = %s\n", rule.Name, clientAddr))
 
-		if rule.AlwaysMatch == true {
-			return rule
+		if !p.active(rule) || rule.exhausted() || !p.ruleMatches(streamType, rule, conn, msg, log) {
+			continue
 		}
 
-		hasClientName := len(rule.ClientName) > 0
-		hasClientAddr := len(rule.ClientAddr) > 0
-		hasCommand := len(rule.Command) > 0
-		hasRawMatchAny := len(rule.RawMatchAny) > 0
-		hasRawMatchAll := len(rule.RawMatchAll) > 0
+		// matches skipped by skipFirst and everyNth go on to the next rule, as for exhausted rules
+		matched := atomic.AddUint64(&rule.matched, 1)
+		if !rule.countsMatch(matched) {
+			log(1, fmt.Sprintf("%s :: Rule '%s' skipped due to skipFirst/everyNth setting, match #%d\n", streamType, rule.Name, matched))
+			continue
+		}
+		return rule
+	}
 
-		matches := (hasClientName || hasClientAddr || hasCommand || hasRawMatchAny || hasRawMatchAll)
+	return nil
+}
 
-		if hasClientName {
-			p.m.RLock()
-			clientName, ok := p.clientNameMap[clientAddr]
-			p.m.RUnlock()
-			matches = matches && ok && clientName == rule.ClientName
-		}
+// ruleMatches evaluates the match directives of a rule against a message
+func (p *Plan) ruleMatches(streamType string, rule *Rule, conn *ConnInfo, msg redcon.RESP, log Logger) bool {
+	if rule.AlwaysMatch == true {
+		return true
+	}
 
-		if hasClientAddr {
-			matches = matches && !strings.HasPrefix(clientAddr, rule.ClientAddr)
-		}
+	m := rule.matcher()
+	if len(rule.When) > 0 {
+		// a rule with no other match directive matches on its expression alone
+		return (m.isEmpty() || p.matches(m, conn, msg)) && p.evalWhen(rule, streamType, conn, msg, log)
+	}
+	return p.matches(m, conn, msg)
+}
+
+// matches evaluates a matcher and its nested matchers against a message
+func (p *Plan) matches(m *Matcher, conn *ConnInfo, msg redcon.RESP) bool {
+	clientAddr := conn.ClientAddr
+
+	hasClientName := len(m.ClientName) > 0
+	hasClientAddr := len(m.ClientAddr) > 0
+	hasConnectionID := m.ConnectionID != nil
+	hasCommand := len(m.Command) > 0
+	hasKey := len(m.KeyPattern) > 0 || len(m.KeyPrefix) > 0
+	hasArgs := m.ArgCount != nil || len(m.Args) > 0
+	hasRawMatchAny := len(m.RawMatchAny) > 0
+	hasRawMatchAll := len(m.RawMatchAll) > 0
+	hasShard := len(m.Shard) > 0
+	hasSlots := len(m.Slots) > 0
+	hasNot := m.Not != nil
+	hasAnyOf := len(m.AnyOf) > 0
+	hasAllOf := len(m.AllOf) > 0
+
+	matches := !m.isEmpty()
+
+	if hasClientName {
+		p.m.RLock()
+		clientName, ok := p.clientNameMap[clientAddr]
+		p.m.RUnlock()
+		matches = matches && ok && clientName == m.ClientName
+	}
+
+	if hasClientAddr {
+		matches = matches && strings.HasPrefix(clientAddr, m.ClientAddr)
+	}
 
-		if hasCommand {
-			if msg.Type != redcon.Array {
-				matches = false
-				continue
+	if hasConnectionID {
+		matches = matches && m.ConnectionID.matches(float64(conn.ID))
+	}
+
+	if hasCommand || hasKey || hasArgs || hasSlots {
+		matchesAny := false
+		for _, req := range requestsFor(conn, msg) {
+			if matchesRequest(m, req) {
+				matchesAny = true
+				break
 			}
-			msg.ForEach(func(r redcon.RESP) bool {
-				matches = matches && string(r.Data) == rule.Command
-				// Redis sends the command name as the first element in an array of bulk strings
-				return false
-			})
-		}
-
-		if hasRawMatchAny {
-			hasAny := false
-			for _, fragment := range rule.RawMatchAny {
-				if bytes.Contains(msg.Data, []byte(fragment)) {
-					hasAny = true
-					break
-				}
+		}
+		matches = matches && matchesAny
+	}
+
+	if hasRawMatchAny {
+		hasAny := false
+		for _, fragment := range m.RawMatchAny {
+			if bytes.Contains(msg.Data, []byte(fragment)) {
+				hasAny = true
+				break
 			}
-			matches = matches && hasAny
 		}
+		matches = matches && hasAny
+	}
+
+	if hasRawMatchAll {
+		for _, fragment := range m.RawMatchAll {
+			matches = matches && bytes.Contains(msg.Data, []byte(fragment))
+		}
+	}
+
+	if hasShard {
+		matches = matches && strings.HasPrefix(conn.UpstreamAddr, m.Shard)
+	}
+
+	if hasNot {
+		matches = matches && !p.matches(m.Not, conn, msg)
+	}
 
-		if hasRawMatchAll {
-			for _, fragment := range rule.RawMatchAll {
-				matches = matches && bytes.Contains(msg.Data, []byte(fragment))
+	if hasAnyOf {
+		matchesAny := false
+		for _, sub := range m.AnyOf {
+			if p.matches(sub, conn, msg) {
+				matchesAny = true
+				break
 			}
 		}
+		matches = matches && matchesAny
+	}
 
-		if matches {
-			return rule
+	if hasAllOf {
+		for _, sub := range m.AllOf {
+			matches = matches && p.matches(sub, conn, msg)
 		}
 	}
 
-	return nil
+	return matches
+}
+
+// requestsFor returns the requests that command and key matchers apply to:
+// the message itself on the request stream, and the request a reply answers on the response stream,
+// along with every command queued in the transaction for a reply to EXEC
+func requestsFor(conn *ConnInfo, msg redcon.RESP) []redcon.RESP {
+	if !conn.Request.Exists() {
+		return []redcon.RESP{msg}
+	}
+	return append([]redcon.RESP{conn.Request}, conn.Transaction...)
+}
+
+// matchesRequest evaluates the command and key matchers of a matcher against a single request
+func matchesRequest(rule *Matcher, req redcon.RESP) bool {
+	if len(rule.Command) > 0 {
+		args, err := respArrToSlice(req)
+		// Redis sends the command name as the first element in an array of bulk strings
+		if err != nil || len(args) == 0 || string(args[0].Data) != rule.Command {
+			return false
+		}
+	}
+
+	if len(rule.KeyPattern) > 0 || len(rule.KeyPrefix) > 0 {
+		if !matchesKeys(rule, req) {
+			return false
+		}
+	}
+
+	if rule.ArgCount != nil || len(rule.Args) > 0 {
+		if !matchesArgs(rule, req) {
+			return false
+		}
+	}
+
+	if len(rule.Slots) > 0 {
+		slot, ok := msgSlot(req)
+		inRange := false
+		for _, slots := range rule.Slots {
+			if ok && slot >= slots[0] && slot <= slots[1] {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false
+		}
+	}
+
+	return true
 }
 
 func clean(s string) string {
@@ -250,8 +572,9 @@ func clean(s string) string {
 }
 
 // SelectRule finds the first rule that applies to the given variables
-func (p *Plan) SelectRule(streamType string, rules []*Rule, clientAddr string, msg redcon.RESP, log Logger) *Rule {
-	rule := p.pickRule(rules, clientAddr, msg, log)
+func (p *Plan) SelectRule(streamType string, rules []*Rule, conn *ConnInfo, msg redcon.RESP, log Logger) *Rule {
+	rule := p.pickRule(streamType, rules, conn, msg, log)
+	clientAddr := conn.ClientAddr
 
 	if rule == nil {
 		return nil
@@ -260,6 +583,9 @@ func (p *Plan) SelectRule(streamType string, rules []*Rule, clientAddr string, m
   log(1, fmt.Sprintf("\n>>> %s :: Rule '%s' matched a command\n", streamType, rule.Name))
 	if rule.Log == false {
 		log(2, fmt.Sprintf("command = \"\n%s\n\"\n", clean(string(msg.Data))))
+		if conn.Request.Exists() {
+			log(2, fmt.Sprintf("request = \"\n%s\n\"\n", clean(string(conn.Request.Data))))
+		}
 	}
 
 	if rule.Log == true {
@@ -272,81 +598,345 @@ func (p *Plan) SelectRule(streamType string, rules []*Rule, clientAddr string, m
 		p.m.RUnlock()
 		log(0, fmt.Sprintf("matched client: client addr = %s, client name = %s\n", clientAddr, clientName))
 		log(0, fmt.Sprintf("matched command: %s\n", clean(string(msg.Data))))
+		if conn.Request.Exists() {
+			log(0, fmt.Sprintf("matched reply to request: %s\n", clean(string(conn.Request.Data))))
+			for _, queued := range conn.Transaction {
+				log(0, fmt.Sprintf("matched reply to queued request: %s\n", clean(string(queued.Data))))
+			}
+		}
 	}
 
-	if rule.Percentage > 0 && rand.Intn(100) > rule.Percentage {
+	if rule.Percentage > 0 && p.random().Intn(100) > rule.Percentage {
 		log(1, "skipped due to percentage setting\n")
 		return nil
 	}
 
-	newHits := atomic.AddUint64(&rule.hits, 1)
+	newHits, ok := rule.hit()
+	if !ok {
+		log(1, "skipped due to maxHits setting\n")
+		return nil
+	}
 	log(2, fmt.Sprintf("times applied = %d\n", newHits))
 	return rule
 }
 
-// // AddRuleMeta adds a rule to the current working plan
-// func (p *Plan) AddRuleMeta(kind string, r Rule) error {
-//   if r.Percentage < 0 || r.Percentage > 100 {
-//   	return fmt.Errorf("Percentage in rule #%s is malformed. it must within 0-100", r.Name)
-//   }
-//
-//   if len(r.Name) <= 0 {
-//   	return fmt.Errorf("Name of rule is required")
-//   }
-//
-//   p.m.Lock()
-//   defer p.m.Unlock()
-//   if _, ok := p.rulesMap[kind+r.Name]; ok {
-//   	return fmt.Errorf("a rule by the same name exists")
-//   }
-//   
-//   p.rulesMap[kind+r.Name] = len(p.RequestRules) - 1
-//
-//   return nil
-// }
-//
-// // TODO: Update HTTP API to distinguish between request and response rules
-//
-// // DeleteRule deletes the given ruleName if found
-// // otherwise it returns ErrNotFound
-// func (p *Plan) DeleteRule(name string) error {
-// 	p.m.Lock()
-// 	defer p.m.Unlock()
-//
-// 	idx, ok := p.rulesMap[name]
-// 	if !ok {
-// 		return ErrNotFound
-// 	}
-//
-// 	p.RequestRules = append(p.RequestRules[:idx], p.RequestRules[idx+1:]...)
-// 	delete(p.rulesMap, name)
-//
-// 	return nil
-// }
-//
-// // GetRule returns the rule that matches the given name
-// func (p *Plan) GetRule(name string) (Rule, error) {
-// 	p.m.RLock()
-// 	defer p.m.RUnlock()
-//
-// 	idx, ok := p.rulesMap[name]
-// 	if !ok {
-// 		return Rule{}, ErrNotFound
-// 	}
-//
-// 	return *p.RequestRules[idx], nil
-// }
-//
-// // ListRules returns a slice of all the existing rules
-// // the slice will be empty if Plan has no rules
-// func (p *Plan) ListRules() []Rule {
-// 	p.m.RLock()
-// 	defer p.m.RUnlock()
-//
-// 	rules := []Rule{}
-// 	for _, rule := range p.RequestRules {
-// 		rules = append(rules, *rule)
-// 	}
-//
-// 	return rules
-// }
+func (r *Rule) validate() error {
+	if r.Percentage < 0 || r.Percentage > 100 {
+		return fmt.Errorf("percentage in rule '%s' is malformed, it must be within 0-100", r.Name)
+	}
+
+	err := validateBandwidth(r)
+	if err != nil {
+		return err
+	}
+
+	err = validateError(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Truncate != nil {
+		err := r.Truncate.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Fragment != nil {
+		err := r.Fragment.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Corrupt != nil {
+		err := r.Corrupt.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Reply != nil {
+		err := r.Reply.compile(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Blackhole != nil {
+		err := r.Blackhole.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = validateSchedule(r)
+	if err != nil {
+		return err
+	}
+
+	err = validateHitLimits(r)
+	if err != nil {
+		return err
+	}
+
+	if r.DialFail != nil {
+		err := r.DialFail.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Disconnect != nil {
+		if r.Drop {
+			return fmt.Errorf("rule '%s' is malformed, drop and disconnect can't be combined", r.Name)
+		}
+		err := r.Disconnect.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Latency != nil {
+		err := r.Latency.validate(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.When) > 0 {
+		when, err := compileExpr(r.When)
+		if err != nil {
+			return fmt.Errorf("when expression in rule '%s' is malformed: %s", r.Name, err)
+		}
+		r.when = when
+	}
+
+	return r.matcher().validate(r.Name)
+}
+
+// validateFor checks a rule held in the rule list of the given kind, some actions only apply to some kinds.
+// Delay, latency, log and drop apply to every kind.
+func (r *Rule) validateFor(kind string) error {
+	err := r.validate()
+	if err != nil {
+		return err
+	}
+
+	messages := []string{RequestStream, ResponseStream, PushStream}
+	actions := []struct {
+		set   bool
+		name  string
+		kinds []string
+	}{
+		{set: r.Bandwidth > 0, name: "bandwidth", kinds: messages},
+		{set: r.Truncate != nil, name: "truncate", kinds: messages},
+		{set: r.Fragment != nil, name: "fragment", kinds: messages},
+		{set: r.Corrupt != nil, name: "corrupt", kinds: []string{ResponseStream, PushStream}},
+		{set: r.Blackhole != nil, name: "blackhole", kinds: messages},
+		{set: len(r.Failover) > 0, name: "failover", kinds: messages},
+		{set: r.answers(), name: "answering with returnEmpty, returnErr, error or reply", kinds: []string{RequestStream, ResponseStream, PushStream, ConnectionStream}},
+		// connection rules answer before any request was read
+		{set: r.Reply != nil && r.Reply.templated(), name: "templating the reply", kinds: messages},
+		{set: r.Disconnect != nil, name: "disconnect", kinds: []string{RequestStream, ResponseStream, PushStream, ConnectionStream}},
+		{set: r.HandshakeFail, name: "handshakeFail", kinds: []string{TLSStream}},
+		{set: r.DialFail != nil, name: "dialFail", kinds: []string{ConnectionStream}},
+	}
+
+	kind = strings.ToLower(kind)
+	for _, action := range actions {
+		if !action.set {
+			continue
+		}
+		applies := false
+		for _, k := range action.kinds {
+			applies = applies || k == kind
+		}
+		if !applies {
+			return fmt.Errorf("rule '%s' is malformed, %s only applies to %s rules", r.Name, action.name, strings.Join(action.kinds, ", "))
+		}
+	}
+	return nil
+}
+
+// rulesFor returns the rule list that applies to the given stream.
+// Callers must hold p.m when reading or replacing the list.
+func (p *Plan) rulesFor(kind string) (*[]*Rule, error) {
+	switch strings.ToLower(kind) {
+	case RequestStream:
+		return &p.RequestRules, nil
+	case ResponseStream:
+		return &p.ResponseRules, nil
+	case PushStream:
+		return &p.PushRules, nil
+	case TLSStream:
+		return &p.TLSRules, nil
+	case ConnectionStream:
+		return &p.ConnectionRules, nil
+	}
+
+	return nil, fmt.Errorf("unknown rule kind '%s', expected one of: %s", kind, strings.Join(ruleKinds, ", "))
+}
+
+func indexOfRule(rules []*Rule, name string) int {
+	for i, rule := range rules {
+		if rule.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// RuleCount returns the number of rules of every kind
+func (p *Plan) RuleCount() int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	count := 0
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		count += len(*rules)
+	}
+	return count
+}
+
+// Rules returns the current rules for the given stream.
+// The returned slice is never modified in place, so it is safe to range over
+// while the plan is being changed through the API.
+func (p *Plan) Rules(kind string) []*Rule {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	rules, err := p.rulesFor(kind)
+	if err != nil {
+		return nil
+	}
+
+	return *rules
+}
+
+// AddRule appends a rule to the rules of the given stream
+func (p *Plan) AddRule(kind string, r Rule) error {
+	if len(r.Name) <= 0 {
+		return fmt.Errorf("name of rule is required")
+	}
+
+	err := r.validateFor(kind)
+	if err != nil {
+		return err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	rules, err := p.rulesFor(kind)
+	if err != nil {
+		return err
+	}
+
+	if indexOfRule(*rules, r.Name) >= 0 {
+		return fmt.Errorf("a rule by the same name exists")
+	}
+
+	// copy on write, readers may still be ranging over the old slice
+	updated := make([]*Rule, 0, len(*rules)+1)
+	updated = append(updated, *rules...)
+	*rules = append(updated, &r)
+	p.keepEdit(kind, -1, &r)
+
+	return nil
+}
+
+// UpdateRule replaces the rule that matches the given name, keeping its position.
+// It returns ErrNotFound if the rule doesn't exist
+func (p *Plan) UpdateRule(kind string, name string, r Rule) error {
+	if len(r.Name) <= 0 {
+		r.Name = name
+	}
+
+	err := r.validateFor(kind)
+	if err != nil {
+		return err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	rules, err := p.rulesFor(kind)
+	if err != nil {
+		return err
+	}
+
+	idx := indexOfRule(*rules, name)
+	if idx < 0 {
+		return ErrNotFound
+	}
+	if r.Name != name && indexOfRule(*rules, r.Name) >= 0 {
+		return fmt.Errorf("a rule by the same name exists")
+	}
+
+	updated := make([]*Rule, len(*rules))
+	copy(updated, *rules)
+	updated[idx] = &r
+	*rules = updated
+	p.keepEdit(kind, idx, &r)
+
+	return nil
+}
+
+// DeleteRule deletes the given ruleName if found
+// otherwise it returns ErrNotFound
+func (p *Plan) DeleteRule(kind string, name string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	rules, err := p.rulesFor(kind)
+	if err != nil {
+		return err
+	}
+
+	idx := indexOfRule(*rules, name)
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	updated := make([]*Rule, 0, len(*rules)-1)
+	updated = append(updated, (*rules)[:idx]...)
+	*rules = append(updated, (*rules)[idx+1:]...)
+	p.keepEdit(kind, idx, nil)
+
+	return nil
+}
+
+// GetRule returns the rule that matches the given name
+func (p *Plan) GetRule(kind string, name string) (*Rule, error) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	rules, err := p.rulesFor(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := indexOfRule(*rules, name)
+	if idx < 0 {
+		return nil, ErrNotFound
+	}
+
+	return (*rules)[idx], nil
+}
+
+// ListRules returns a slice of all the existing rules for the given stream
+// the slice will be empty if Plan has no rules
+func (p *Plan) ListRules(kind string) ([]*Rule, error) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	rules, err := p.rulesFor(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]*Rule{}, *rules...), nil
+}
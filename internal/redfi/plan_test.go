@@ -2,6 +2,8 @@ package redfi
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -51,6 +53,11 @@ func Resp(b []byte) redcon.RESP {
 	return resp
 }
 
+func Resp3(b []byte) redcon.RESP {
+	_, resp := ReadNextRESP(b)
+	return resp
+}
+
 func TestSelectRuleRawMatchAll(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -79,6 +86,7 @@ func TestSelectRuleRawMatchAll(t *testing.T) {
 				Name:        "2",
 				RawMatchAll: []string{"123", "abc"},
 				hits:        1,
+				matched:     1,
 			},
 		},
 
@@ -122,7 +130,7 @@ func TestSelectRuleRawMatchAll(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		output := c.plan.SelectRule("request", c.plan.RequestRules, c.listen, c.msg, MakeLogger(0))
+		output := c.plan.SelectRule("request", c.plan.RequestRules, &ConnInfo{ClientAddr: c.listen}, c.msg, MakeLogger(0))
 		if !reflect.DeepEqual(c.expected, output) {
 			t.Fatal(fmt.Sprintf(
 				"Case failed:\n\t%s:\n\texpected = %#v\n\toutput   = %#v",
@@ -162,6 +170,7 @@ func TestSelectRuleRawMatchAny(t *testing.T) {
 				Name:        "2",
 				RawMatchAny: []string{"123", "abc"},
 				hits:        1,
+				matched:     1,
 			},
 		},
 
@@ -185,6 +194,7 @@ func TestSelectRuleRawMatchAny(t *testing.T) {
 				Name:        "1",
 				RawMatchAny: []string{"321", "123"},
 				hits:        1,
+				matched:     1,
 			},
 		},
 
@@ -209,7 +219,7 @@ func TestSelectRuleRawMatchAny(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		output := c.plan.SelectRule("request", c.plan.RequestRules, c.addr, c.msg, MakeLogger(0))
+		output := c.plan.SelectRule("request", c.plan.RequestRules, &ConnInfo{ClientAddr: c.addr}, c.msg, MakeLogger(0))
 		if !reflect.DeepEqual(c.expected, output) {
 			t.Fatal(fmt.Sprintf(
 				"Case failed:\n\t%s:\n\texpected = %#v\n\toutput   = %#v",
@@ -221,38 +231,189 @@ func TestSelectRuleRawMatchAny(t *testing.T) {
 	}
 }
 
-// func TestAddDeleteGetRule(t *testing.T) {
-// 	p := NewPlan()
-//
-// 	r := Rule{
-// 		Name:       "clients_delay",
-// 		Delay:      50,
-// 		Percentage: 20,
-// 	}
-// 	p.AddRule(r)
-//
-// 	if len(p.Rules) != 1 {
-// 		t.Fatal("rule wasn't added")
-// 	}
-// 	if !(p.Rules[0].Delay == r.Delay && p.Rules[0].Percentage == r.Percentage) {
-// 		t.Fatal("rule added doesn't match")
-// 	}
-//
-// 	fetchedRule, err := p.GetRule("clients_delay")
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	fmt.Println(fetchedRule)
-//
-// 	err = p.DeleteRule("clients_delay")
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-//
-// 	_, err = p.GetRule("clients_delay")
-// 	if err == nil {
-// 		t.Fatal(err)
-// 	}
-// 	fmt.Println(fetchedRule)
-//
-// }
+func TestAddDeleteGetRule(t *testing.T) {
+	p := NewPlan()
+
+	r := Rule{
+		Name:       "clients_delay",
+		Delay:      50,
+		Percentage: 20,
+	}
+	err := p.AddRule(ResponseStream, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.ResponseRules) != 1 || len(p.RequestRules) != 0 {
+		t.Fatal("rule wasn't added to the response rules")
+	}
+	if !(p.ResponseRules[0].Delay == r.Delay && p.ResponseRules[0].Percentage == r.Percentage) {
+		t.Fatal("rule added doesn't match")
+	}
+
+	err = p.AddRule(ResponseStream, r)
+	if err == nil {
+		t.Fatal("duplicate rule must be rejected")
+	}
+
+	_, err = p.GetRule(RequestStream, "clients_delay")
+	if err != ErrNotFound {
+		t.Fatal("rule must not be found in the request rules")
+	}
+
+	err = p.UpdateRule(ResponseStream, "clients_delay", Rule{Delay: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetchedRule, err := p.GetRule(ResponseStream, "clients_delay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchedRule.Delay != 100 {
+		t.Fatal("rule wasn't updated")
+	}
+
+	err = p.DeleteRule(ResponseStream, "clients_delay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.GetRule(ResponseStream, "clients_delay")
+	if err == nil {
+		t.Fatal("rule must be deleted")
+	}
+
+	err = p.AddRule("sideways", r)
+	if err == nil {
+		t.Fatal("unknown rule kind must be rejected")
+	}
+}
+
+func TestReloadPlan(t *testing.T) {
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	err := os.WriteFile(planPath, []byte(`{"requestRules": [{"name": "1", "delay": 10}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := New(planPath, "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(planPath, []byte(`{"requestRules": [{"name": "2", "delay": 20}], "responseRules": [{"name": "3"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proxy.ReloadPlan(MakeLogger(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := proxy.Plan().Rules(RequestStream)
+	if len(rules) != 1 || rules[0].Name != "2" || len(proxy.Plan().Rules(ResponseStream)) != 1 {
+		t.Fatal("plan wasn't reloaded")
+	}
+
+	err = os.WriteFile(planPath, []byte(`{"requestRules": [`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proxy.ReloadPlan(MakeLogger(-1))
+	if err == nil {
+		t.Fatal("malformed plan must be rejected")
+	}
+
+	rules = proxy.Plan().Rules(RequestStream)
+	if len(rules) != 1 || rules[0].Name != "2" {
+		t.Fatal("previous plan must be kept when the new one fails to parse")
+	}
+}
+
+func TestSelectRuleResponseCorrelation(t *testing.T) {
+	getUser := Resp([]byte("*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n"))
+	setUser := Resp([]byte("*3\r\n$3\r\nSET\r\n$6\r\nuser:1\r\n$1\r\nx\r\n"))
+	exec := Resp([]byte("*1\r\n$4\r\nEXEC\r\n"))
+
+	cases := []struct {
+		name     string
+		conn     *ConnInfo
+		msg      redcon.RESP
+		expected string
+	}{
+		{
+			name:     "reply to GET",
+			conn:     &ConnInfo{Request: getUser},
+			msg:      Resp([]byte("$1\r\nx\r\n")),
+			expected: "get",
+		},
+		{
+			name:     "reply to SET",
+			conn:     &ConnInfo{Request: setUser},
+			msg:      Resp([]byte("+OK\r\n")),
+			expected: "",
+		},
+		{
+			name:     "reply to EXEC with a queued GET",
+			conn:     &ConnInfo{Request: exec, Transaction: []redcon.RESP{setUser, getUser}},
+			msg:      Resp([]byte("*2\r\n+OK\r\n$1\r\nx\r\n")),
+			expected: "get",
+		},
+		{
+			name:     "reply nobody asked for is matched on its own",
+			conn:     &ConnInfo{},
+			msg:      Resp([]byte("*2\r\n$3\r\nGET\r\n$1\r\nx\r\n")),
+			expected: "get",
+		},
+	}
+
+	for _, c := range cases {
+		p := &Plan{ResponseRules: []*Rule{{Name: "get", Command: "GET"}}}
+		output := p.SelectRule("RESPONSE", p.ResponseRules, c.conn, c.msg, MakeLogger(-1))
+		name := ""
+		if output != nil {
+			name = output.Name
+		}
+		if name != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, c.expected, name))
+		}
+	}
+}
+
+func TestRuleValidateFor(t *testing.T) {
+	cases := []struct {
+		name     string
+		kind     string
+		rule     Rule
+		expected bool
+	}{
+		{name: "delay on any kind", kind: TLSStream, rule: Rule{Delay: 10}, expected: true},
+		{name: "drop on a connection rule", kind: ConnectionStream, rule: Rule{Drop: true}, expected: true},
+		{name: "error on a connection rule", kind: ConnectionStream, rule: Rule{Error: "LOADING"}, expected: true},
+		{name: "refusal on a connection rule", kind: ConnectionStream, rule: Rule{Disconnect: &Disconnect{Mode: RstDisconnect}}, expected: true},
+		{name: "dialFail on a connection rule", kind: ConnectionStream, rule: Rule{DialFail: &DialFail{}}, expected: true},
+		{name: "handshakeFail on a TLS rule", kind: TLSStream, rule: Rule{HandshakeFail: true}, expected: true},
+		{name: "blackhole on a request rule", kind: RequestStream, rule: Rule{Blackhole: &Blackhole{}}, expected: true},
+		{name: "reply template on a response rule", kind: ResponseStream, rule: Rule{Reply: &ReplyValue{Type: "bulk", Value: "{{.Command}}"}}, expected: true},
+		{name: "plain reply on a connection rule", kind: ConnectionStream, rule: Rule{Reply: &ReplyValue{Type: "error", Value: "ERR full"}}, expected: true},
+		{name: "reply template on a connection rule", kind: ConnectionStream, rule: Rule{Reply: &ReplyValue{Type: "array", Elements: []*ReplyValue{{Type: "bulk", Value: "{{.Command}}"}}}}, expected: false},
+		{name: "blackhole on a connection rule", kind: ConnectionStream, rule: Rule{Blackhole: &Blackhole{}}, expected: false},
+		{name: "bandwidth on a connection rule", kind: ConnectionStream, rule: Rule{Bandwidth: 100}, expected: false},
+		{name: "truncate on a TLS rule", kind: TLSStream, rule: Rule{Truncate: &Truncate{Bytes: 1}}, expected: false},
+		{name: "fragment on a connection rule", kind: ConnectionStream, rule: Rule{Fragment: &Fragment{Size: 1}}, expected: false},
+		{name: "failover on a connection rule", kind: ConnectionStream, rule: Rule{Failover: "mymaster"}, expected: false},
+		{name: "error on a TLS rule", kind: TLSStream, rule: Rule{ReturnErr: "ERR tls"}, expected: false},
+		{name: "handshakeFail on a connection rule", kind: ConnectionStream, rule: Rule{HandshakeFail: true}, expected: false},
+		{name: "dialFail on a request rule", kind: RequestStream, rule: Rule{DialFail: &DialFail{}}, expected: false},
+		{name: "dialFail on a response rule", kind: ResponseStream, rule: Rule{DialFail: &DialFail{Timeout: 10}}, expected: false},
+	}
+
+	for _, c := range cases {
+		c.rule.Name = "rule"
+		err := c.rule.validateFor(c.kind)
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected valid = %t\n\toutput         = %v", c.name, c.expected, err))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package redfi
+
+import (
+	"github.com/tidwall/redcon"
+)
+
+// subscribeCommands maps the pub/sub commands Redis confirms once per channel or pattern
+// to the subscriptions they add to or remove from
+var subscribeCommands = map[string]string{
+	"subscribe":    "subscribe",
+	"unsubscribe":  "subscribe",
+	"psubscribe":   "psubscribe",
+	"punsubscribe": "psubscribe",
+	"ssubscribe":   "ssubscribe",
+	"sunsubscribe": "ssubscribe",
+}
+
+// expectedReplies returns how many replies Redis sends to a request, -1 when it's only known once Redis answers.
+// queued is set for requests sent within a transaction, which Redis answers once.
+func expectedReplies(command string, req redcon.RESP, queued bool) int {
+	if _, ok := subscribeCommands[command]; !ok || queued {
+		return 1
+	}
+
+	args, err := respArrToSlice(req)
+	if err != nil {
+		return 1
+	}
+	if len(args) > 1 {
+		// a confirmation per channel or pattern
+		return len(args) - 1
+	}
+	if subscribeCommands[command] != command {
+		// unsubscribing from everything, a confirmation per subscription
+		return -1
+	}
+	// subscribing to nothing is an error
+	return 1
+}
+
+// subscription returns the command and the channel confirmed by msg, ok is false if msg isn't a confirmation.
+// RESP2 clients get confirmations as arrays, RESP3 clients as push messages.
+func subscription(msg redcon.RESP) (command string, channel string, ok bool) {
+	if (msg.Type != redcon.Array && msg.Type != Push) || msg.Count != 3 {
+		return "", "", false
+	}
+
+	args := []redcon.RESP{}
+	forEachRESP(msg, func(arg redcon.RESP) bool {
+		args = append(args, arg)
+		return true
+	})
+	if len(args) != 3 || args[2].Type != redcon.Integer {
+		return "", "", false
+	}
+
+	command = rlower(args[0])
+	if _, ok := subscribeCommands[command]; !ok {
+		return "", "", false
+	}
+	return command, string(args[1].Data), true
+}
+
+// isPubSubMessage reports whether msg is a message published to a channel the client subscribed to
+func isPubSubMessage(msg redcon.RESP) bool {
+	if msg.Type != redcon.Array && msg.Type != Push {
+		return false
+	}
+
+	kind := ""
+	forEachRESP(msg, func(arg redcon.RESP) bool {
+		kind = rlower(arg)
+		return false
+	})
+	return kind == "message" || kind == "pmessage" || kind == "smessage"
+}
+
+// isReply reports whether msg answers the oldest pending request, callers must hold s.m
+func (s *session) isReply(msg redcon.RESP) bool {
+	if len(s.pending) == 0 {
+		return false
+	}
+	if command, _, ok := subscription(msg); ok {
+		// Redis also unsubscribes clients on its own, e.g. when a shard channel moves to another node
+		return s.pending[0].command == command
+	}
+	if msg.Type == Push {
+		return false
+	}
+	return len(s.subscriptions) == 0 || !isPubSubMessage(msg)
+}
+
+// subscribed keeps track of the subscriptions of the client as Redis confirms them, callers must hold s.m
+func (s *session) subscribed(command, channel string) {
+	kind := subscribeCommands[command]
+	channels := s.subscriptions[kind]
+
+	if command == kind {
+		if channels == nil {
+			channels = map[string]bool{}
+			if s.subscriptions == nil {
+				s.subscriptions = map[string]map[string]bool{}
+			}
+			s.subscriptions[kind] = channels
+		}
+		channels[channel] = true
+		return
+	}
+
+	delete(channels, channel)
+	if len(channels) == 0 {
+		delete(s.subscriptions, kind)
+	}
+}
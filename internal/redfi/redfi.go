@@ -2,29 +2,256 @@ package redfi
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-
-	// "net/http"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	// "github.com/go-chi/chi"
-	// "github.com/go-chi/chi/middleware"
-
 	"github.com/tidwall/redcon"
 )
 
 type Proxy struct {
 	redisAddr string
 	plan      *Plan
+	planPath  string
 	listen    string
-	// apiAddr   string
-	// api			 *API
-	logging string
+	apiAddr   string
+	api       *API
+	logging   string
+	// nil unless the proxy fronts a Redis Cluster
+	cluster *cluster
+	// nil unless the proxy fronts a Redis Sentinel
+	sentinel *sentinel
+
+	// nil unless TLS is terminated on the client listeners
+	tlsConfig *tls.Config
+	// nil unless the proxy connects to Redis over TLS
+	redisTLS *tls.Config
+
+	// live proxied connections
+	sessions  map[*session]bool
+	sessionsM sync.Mutex
+}
+
+// ConnInfo describes the proxied connection a message was read from
+type ConnInfo struct {
+	// unique to each connection accepted by the proxy
+	ID           uint64
+	ClientAddr   string
+	UpstreamAddr string
+
+	// set when matching a reply: the request it answers,
+	// and for a reply to EXEC, the commands queued in the transaction
+	Request     redcon.RESP
+	Transaction []redcon.RESP
+}
+
+// last connection ID handed out
+var lastConnID uint64
+
+// session holds the state of a single proxied connection
+type session struct {
+	ConnInfo
+	client   net.Conn
+	upstream net.Conn
+
+	// replies the client is waiting for, in the order the requests were received
+	pending []pendingReply
+	// commands queued since MULTI, nil outside of a transaction
+	transaction []redcon.RESP
+	// channels, patterns and shard channels the client subscribed to, keyed by subscribe command
+	subscriptions map[string]map[string]bool
+	// set once the client switched to RESP3 with HELLO 3
+	resp3 bool
+	// how +switch-master messages are delivered to this client, e.g. ["pmessage", "*"],
+	// empty unless the client subscribed to them through a sentinel
+	switchMaster []string
+	// bandwidth of the rules that apply to this connection only
+	throttles map[*Rule]*throttle
+	m         sync.Mutex
+	// held while a shaped message is written to the client, so nothing is written in the middle of it
+	w sync.Mutex
+	// set once a truncated message stalled a side of the connection, nothing is sent to that side afterwards
+	stalledClient   bool
+	stalledUpstream bool
+	// set once a rule half-closed the client for reading, Redis is still read from
+	readClosedClient bool
+	// closed once the client is gone
+	done chan struct{}
+}
+
+// pendingReply is a reply the client is waiting for
+type pendingReply struct {
+	request redcon.RESP
+	// lowercase name of the request, see commandName
+	command string
+	// commands queued in the transaction, for a reply to EXEC
+	transaction []redcon.RESP
+	// set when the request was short-circuited, the reply is sent to the client without involving Redis
+	reply []byte
+	// replies Redis has yet to send, more than one for pub/sub commands, see expectedReplies
+	replies int
+	// set for commands queued in a transaction, Redis acknowledges them with +QUEUED and answers them in the reply to EXEC
+	queued bool
+}
+
+// expectReply records a request forwarded to Redis, it must be called before the request is written
+func (s *session) expectReply(req redcon.RESP) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	pending := pendingReply{request: req, command: commandName(req)}
+	pending.queued = s.transaction != nil && pending.command != "exec" && pending.command != "discard" && pending.command != "multi"
+	pending.replies = expectedReplies(pending.command, req, pending.queued)
+	switch pending.command {
+	case "multi":
+		s.transaction = []redcon.RESP{}
+	case "exec":
+		pending.transaction = s.transaction
+		s.transaction = nil
+	case "discard":
+		s.transaction = nil
+	default:
+		if s.transaction != nil {
+			s.transaction = append(s.transaction, req)
+		}
+	}
+
+	s.pending = append(s.pending, pending)
+}
+
+// handleHello records the protocol the client switches to with HELLO
+func (s *session) handleHello(msg redcon.RESP) {
+	args, err := respArrToSlice(msg)
+	if err != nil || len(args) < 2 || rlower(args[0]) != "hello" {
+		return
+	}
+
+	s.m.Lock()
+	s.resp3 = string(args[1].Data) == "3"
+	s.m.Unlock()
+}
+
+// shortCircuit answers a request without forwarding it to Redis.
+// The reply is held back until Redis answered every request received before this one.
+func (s *session) shortCircuit(req redcon.RESP, reply []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if len(s.pending) > 0 {
+		s.pending = append(s.pending, pendingReply{request: req, command: commandName(req), reply: reply})
+		return nil
+	}
+
+	if s.stalledClient {
+		return nil
+	}
+	_, err := s.client.Write(reply)
+	return err
+}
+
+// stall stops sending anything to dst, either the client or Redis, while keeping the connection open
+func (s *session) stall(dst net.Conn) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if dst == s.client {
+		s.stalledClient = true
+	} else {
+		s.stalledUpstream = true
+	}
+}
+
+// stalled reports whether messages to dst are discarded, see stall
+func (s *session) stalled(dst net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if dst == s.client {
+		return s.stalledClient
+	}
+	return s.stalledUpstream
+}
+
+// closeRead records that a rule stopped reading from conn, see Disconnect
+func (s *session) closeRead(conn net.Conn) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if conn == s.client {
+		s.readClosedClient = true
+	}
+}
+
+// readClosed reports whether the client stopped being read on purpose, rather than left
+func (s *session) readClosed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.readClosedClient
+}
+
+// nextReply returns the request msg, a message from Redis, answers.
+// It's empty when Redis sends a message nobody asked for, e.g. pub/sub messages.
+func (s *session) nextReply(msg redcon.RESP) pendingReply {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.isReply(msg) {
+		return pendingReply{}
+	}
+	return s.pending[0]
+}
+
+// replied marks the oldest request as answered by msg, once Redis sent every reply to it,
+// the short-circuited replies that were waiting on it are sent
+func (s *session) replied(msg redcon.RESP) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.isReply(msg) {
+		return nil
+	}
+
+	pending := &s.pending[0]
+	if command, channel, ok := subscription(msg); ok {
+		if pending.replies < 0 {
+			// unsubscribing from everything, Redis confirms once even without subscriptions
+			pending.replies = len(s.subscriptions[subscribeCommands[command]])
+			if pending.replies == 0 {
+				pending.replies = 1
+			}
+		}
+		s.subscribed(command, channel)
+		pending.replies--
+	} else {
+		// anything else, such as an error, is the only reply
+		pending.replies = 0
+	}
+
+	if pending.replies > 0 {
+		return nil
+	}
+	s.pending = s.pending[1:]
+
+	for len(s.pending) > 0 && s.pending[0].reply != nil {
+		if !s.stalledClient {
+			_, err := s.client.Write(s.pending[0].reply)
+			if err != nil {
+				return err
+			}
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
 }
 
 func (p *Proxy) Plan() *Plan {
@@ -33,15 +260,46 @@ func (p *Proxy) Plan() *Plan {
 
 func factory(server string) func() (net.Conn, error) {
 	return func() (net.Conn, error) {
-		return net.Dial("tcp", server)
+		network, address := splitAddr(server)
+		return net.Dial(network, address)
+	}
+}
+
+// splitAddr returns the network and address to use for addr,
+// addresses like unix:/path/to/redis.sock are unix domain sockets, anything else is TCP
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
 	}
+	return "tcp", addr
+}
+
+func listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		// clean up the socket left behind by a previous run
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// clientAddr returns the address rules match clientAddr against.
+// Unix domain socket peers have no address, they are named after the socket and the connection ID instead,
+// e.g. unix:/tmp/redfi.sock#12
+func clientAddr(conn net.Conn, id uint64) string {
+	if conn.LocalAddr().Network() == "unix" {
+		return fmt.Sprintf("unix:%s#%d", conn.LocalAddr().String(), id)
+	}
+	return conn.RemoteAddr().String()
 }
 
 func New(
 	planPath string,
 	redisAddr string,
 	listen string,
-	// apiAddr string,
+	apiAddr string,
 	logging string,
 ) (*Proxy, error) {
 	plan := NewPlan()
@@ -57,42 +315,33 @@ func New(
 	return &Proxy{
 		redisAddr: redisAddr,
 		plan:      plan,
+		planPath:  planPath,
 		listen:    listen,
-		// api:			 NewAPI(plan),
-		// apiAddr: apiAddr,
-		logging: logging,
+		api:       NewAPI(plan),
+		apiAddr:   apiAddr,
+		logging:   logging,
+		sessions:  map[*session]bool{},
 	}, nil
 }
 
-// func (p *Proxy) StartAPI() {
-// 	r := chi.NewRouter()
-// 	r.Use(middleware.RequestID)
-// 	r.Use(middleware.RealIP)
-// 	// r.Use(middleware.Recoverer)
-// 	r.Use(middleware.Timeout(60 * time.Second))
-//
-// 	// RESTy routes for "rules" resource
-// 	r.Route("/rules", func(r chi.Router) {
-// 		r.Get("/", p.api.listRules) // GET /rules
-//
-// 		r.Post("/", p.api.createRule) // POST /rules
-//
-// 		// Subrouters:
-// 		r.Route("/{ruleName}", func(r chi.Router) {
-// 			r.Get("/", p.api.getRule)			 // GET /rules/drop_20
-// 			r.Delete("/", p.api.deleteRule) // DELETE /rules/drop_20
-// 		})
-// 	})
-//
-// 	fmt.Printf("control %s\n", p.apiAddr)
-// 	err := http.ListenAndServe(p.apiAddr, r)
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-// }
+// StartAPI serves the HTTP control API on apiAddr, it blocks until the listener fails
+func (p *Proxy) StartAPI() {
+	srv := &http.Server{
+		Addr:         p.apiAddr,
+		Handler:      p.api.Handler(),
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	fmt.Printf("control %s\n", p.apiAddr)
+	err := srv.ListenAndServe()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
 func (p *Proxy) Start(logger Logger) error {
-	ln, err := net.Listen("tcp", p.listen)
+	ln, err := listen(p.listen)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -100,33 +349,102 @@ func (p *Proxy) Start(logger Logger) error {
 	fmt.Printf("redis %s\n", p.redisAddr)
 	fmt.Printf("proxy %s\n", p.listen)
 
+	if p.sentinel != nil {
+		p.sentinel.discover(logger)
+	}
+
+	if p.cluster != nil {
+		err = p.cluster.discover(logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	p.serve(ln, p.redisAddr, logger)
+	return nil
+}
+
+// serve accepts client connections on ln and proxies them to upstreamAddr
+func (p *Proxy) serve(ln net.Listener, upstreamAddr string, logger Logger) {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		go p.handle(conn, logger)
+		go p.handle(conn, upstreamAddr, logger)
 	}
 }
 
-func (p *Proxy) handle(conn net.Conn, logger Logger) {
+func (p *Proxy) handle(conn net.Conn, upstreamAddr string, logger Logger) {
 	var wg sync.WaitGroup
 
-	targetConn, err := net.Dial("tcp", p.redisAddr)
+	info := ConnInfo{
+		ID:           atomic.AddUint64(&lastConnID, 1),
+		UpstreamAddr: upstreamAddr,
+	}
+	info.ClientAddr = clientAddr(conn, info.ID)
+
+	rule, ok := p.admit(conn, &info, logger)
+	if !ok {
+		return
+	}
+
+	if p.tlsConfig != nil {
+		tlsConn, err := p.handshake(conn, &info, logger)
+		if err != nil {
+			log.Println("TLS handshake with client failed:", err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
+	if rule != nil && rule.answers() {
+		p.turnAway(conn, rule, logger)
+		return
+	}
+
+	targetConn, err := p.dialUpstream(rule, upstreamAddr, logger)
 	if err != nil {
-		log.Println("failed to connect to redis")
+		log.Println("failed to connect to redis:", err)
     conn.Close()
     return
 	}
 
+	s := &session{
+		ConnInfo: info,
+		client:   conn,
+		upstream: targetConn,
+		done:     make(chan struct{}),
+	}
+
+	p.sessionsM.Lock()
+	p.sessions[s] = true
+	p.sessionsM.Unlock()
+	defer func() {
+		p.sessionsM.Lock()
+		delete(p.sessions, s)
+		p.sessionsM.Unlock()
+		p.plan.forgetClient(s.ClientAddr)
+		p.plan.releaseBlackhole(s, nil)
+	}()
+
 	wg.Add(2)
 	go func() {
-		p.requestFaulter(targetConn, conn, logger)
+		p.requestFaulter(s, logger)
+		close(s.done)
+		// the client is gone, stop waiting on redis, unless it was only half-closed
+		if !s.readClosed() {
+			targetConn.Close()
+		}
 		wg.Done()
 	}()
 	go func() {
-		p.responseFaulter(conn, targetConn, logger)
+		p.responseFaulter(s, logger)
 		wg.Done()
 	}()
 	wg.Wait()
@@ -134,6 +452,34 @@ func (p *Proxy) handle(conn net.Conn, logger Logger) {
 	log.Println("Close connection", conn.Close())
 }
 
+// closeSessions drops every live connection proxied to upstreamAddr
+func (p *Proxy) closeSessions(upstreamAddr string) {
+	p.sessionsM.Lock()
+	defer p.sessionsM.Unlock()
+
+	for s := range p.sessions {
+		if s.UpstreamAddr == upstreamAddr {
+			s.client.Close()
+			s.upstream.Close()
+		}
+	}
+}
+
+// handleProxyActions applies the rule actions that reach beyond the current connection
+func (p *Proxy) handleProxyActions(rule *Rule, logger Logger) {
+	if rule == nil {
+		return
+	}
+
+	if len(rule.Failover) > 0 {
+		if p.sentinel == nil {
+			logger(0, fmt.Sprintf("Ignoring failover, the proxy isn't in sentinel mode: rule = %s\n", rule.Name))
+		} else {
+			go p.sentinel.failover(rule.Failover, logger)
+		}
+	}
+}
+
 func (p *Proxy) pipe(dst, src net.Conn) {
 	buf := make([]byte, 32<<10)
 
@@ -156,119 +502,220 @@ func (p *Proxy) pipe(dst, src net.Conn) {
 	}
 }
 
-func (p *Plan) handleRule(streamType string, msg redcon.RESP, rule *Rule, src, dst net.Conn, logger Logger) {
-	if rule != nil && rule.Delay > 0 {
-		logger(1, fmt.Sprintf("%s :: Delaying packet: rule = %s, delay = %dms\n", streamType, rule.Name, rule.Delay))
-		time.Sleep(time.Duration(rule.Delay) * time.Millisecond)
+// answers reports whether a rule answers with its own reply instead of Redis
+func (r *Rule) answers() bool {
+	return r.ReturnEmpty || len(r.ReturnErr) > 0 || len(r.Error) > 0 || r.Reply != nil
+}
+
+// syntheticReply returns the reply a rule answers the given request with instead of Redis, if any
+func (r *Rule) syntheticReply(req redcon.RESP) []byte {
+	if r.ReturnEmpty {
+		return []byte("$-1\r\n")
+	}
+	if len(r.ReturnErr) > 0 {
+		return redcon.AppendError(nil, r.ReturnErr)
+	}
+	if len(r.Error) > 0 {
+		return presetError(r.Error, req)
+	}
+	if r.Reply != nil {
+		reply, err := r.Reply.appendReply(nil, newReplyContext(req))
+		if err != nil {
+			// the client still gets an answer, so it doesn't wait forever
+			return redcon.AppendError(nil, fmt.Sprintf("ERR redfi: reply of rule '%s' failed: %s", r.Name, err))
+		}
+		return reply
+	}
+	return nil
+}
+
+func (p *Plan) handleRule(streamType string, msg redcon.RESP, rule *Rule, s *session, logger Logger) {
+	dst := s.client
+	if streamType == "REQUEST" {
+		dst = s.upstream
+	}
+
+	if rule != nil && (rule.Delay > 0 || rule.Latency != nil) {
+		delay := p.delayFor(rule)
+		logger(1, fmt.Sprintf("%s :: Delaying packet: rule = %s, delay = %s\n", streamType, rule.Name, delay))
+		time.Sleep(delay)
 		logger(1, fmt.Sprintf("%s :: Delay complete, sending message: rule = %s\n", streamType, rule.Name))
 	}
 
+	if s.stalled(dst) {
+		logger(2, fmt.Sprintf("%s :: Discarding message to stalled connection\n", streamType))
+		return
+	}
+
+	// blackholes are waited out before taking the plan lock, a held connection doesn't hold up the others
+	if rule != nil && rule.Blackhole != nil {
+		p.startBlackhole(streamType, rule, s, logger)
+	}
+	if !p.passBlackhole(streamType, s, dst, logger) {
+		return
+	}
+	if streamType == "REQUEST" && rule != nil && rule.answers() && !p.passBlackhole(streamType, s, s.client, logger) {
+		// the reply to a short-circuited request is held like the replies from Redis
+		return
+	}
+
+	raw := msg.Raw
+	if rule != nil && rule.Corrupt != nil && streamType != "REQUEST" {
+		raw = rule.Corrupt.apply(msg.Raw, p.random())
+		logger(1, fmt.Sprintf("%s :: Corrupting reply: rule = %s, mode = %s\n", streamType, rule.Name, rule.Corrupt.Mode))
+	}
+
+	if rule != nil && rule.shapesDelivery() && !rule.disconnects() && !rule.answers() {
+		// shaped messages are written outside of the plan lock, so a slow link doesn't hold up other connections
+		if streamType == "REQUEST" {
+			s.expectReply(msg)
+		} else {
+			s.w.Lock()
+			defer s.w.Unlock()
+		}
+
+		err := p.deliver(streamType, raw, rule, s, dst, logger)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
 	p.m.Lock()
 	defer p.m.Unlock()
 
 	if rule != nil {
-		if rule.Drop {
-			logger(1, fmt.Sprintf("%s :: Dropping connection with client: rule = %s", streamType, rule.Name))
-			err := src.Close()
-			if err != nil {
-				log.Println("encountered error while closing srcConn", err)
-			}
+		if rule.disconnects() {
+			p.disconnect(streamType, rule, s, logger)
 			return
 		}
 
-		if rule.ReturnEmpty {
-			logger(1, fmt.Sprintf("%s :: Returning empty: rule = %s", streamType, rule.Name))
-			_, err := dst.Write([]byte("$-1\r\n"))
-			if err != nil {
-				log.Println(err)
+		if rule.answers() {
+			// replies are templated from the request they answer
+			req := msg
+			if streamType != "REQUEST" {
+				req = s.nextReply(msg).request
+			}
+			reply := rule.syntheticReply(req)
+
+			if rule.ReturnEmpty {
+				logger(1, fmt.Sprintf("%s :: Returning empty: rule = %s", streamType, rule.Name))
+			} else if len(rule.ReturnErr) > 0 || len(rule.Error) > 0 {
+				logger(1, fmt.Sprintf("%s :: Returning error: rule = %s, error = '%s'", streamType, rule.Name, clean(string(reply))))
+			} else {
+				logger(1, fmt.Sprintf("%s :: Returning reply: rule = %s, reply = '%s'", streamType, rule.Name, clean(string(reply))))
 			}
-		}
 
-		if len(rule.ReturnErr) > 0 {
-			logger(1, fmt.Sprintf("%s :: Returning error: rule = %s, error = '%s'", streamType, rule.Name, rule.ReturnErr))
-			buf := []byte{}
-			buf = redcon.AppendError(buf, rule.ReturnErr)
-			_, err := dst.Write(buf)
+			var err error
+			if streamType == "REQUEST" {
+				// the request never reaches redis
+				err = s.shortCircuit(msg, reply)
+			} else {
+				// the reply from redis is replaced
+				_, err = dst.Write(reply)
+			}
 			if err != nil {
 				log.Println(err)
 			}
+			return
 		}
 	}
 
-	_, err := dst.Write(msg.Raw)
+	if streamType == "REQUEST" {
+		s.expectReply(msg)
+	}
+
+	_, err := dst.Write(raw)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
-func (p *Proxy) requestFaulter(dst, src net.Conn, logger Logger) {
-	srcRd := bufio.NewReader(src)
+func (p *Proxy) requestFaulter(s *session, logger Logger) {
+	srcRd := bufio.NewReader(s.client)
 
 	for {
-		var buf []byte
-		var msg redcon.RESP
-		// Read a complete RESP command and preserve any extra data (will be part of the next packet)
-		for {
-			line, err := srcRd.ReadBytes('\n')
-			if err != nil {
+		msg, err := readMessage(srcRd)
+		if err != nil {
+			if err != io.EOF {
 				log.Println(err)
-				if err == io.EOF || err == os.ErrClosed {
-					return
-				}
-			}
-
-			buf = append(buf, line...)
-			n, resp := redcon.ReadNextRESP(buf)
-			if n != 0 {
-				msg = resp
-				break
 			}
+			return
 		}
 
-		clientAddr := src.RemoteAddr().String()
-		p.plan.handleClientSetName(clientAddr, msg)
-		rule := p.plan.SelectRule("REQUEST", p.plan.RequestRules, clientAddr, msg, logger)
+		p.plan.handleClientSetName(s.ClientAddr, msg)
+		s.handleHello(msg)
+		if p.sentinel != nil {
+			p.sentinel.handleSubscribe(s, msg)
+		}
+		rule := p.plan.SelectRule("REQUEST", p.plan.Rules(RequestStream), &s.ConnInfo, msg, logger)
+		p.handleProxyActions(rule, logger)
 
 		// if p.plan.MsgOrdering == "unordered" || (rule != nil && p.plan.MsgOrdering == "unordered-delays" && rule.Delay > 0) {
-		// 	go p.plan.handleRule("REQUEST", msg, rule, src, dst, logger)
+		// 	go p.plan.handleRule("REQUEST", msg, rule, s, logger)
 		// } else {
-		p.plan.handleRule("REQUEST", msg, rule, src, dst, logger)
+		p.plan.handleRule("REQUEST", msg, rule, s, logger)
 		// }
 	}
 }
 
-func (p *Proxy) responseFaulter(dst, src net.Conn, logger Logger) {
-	srcRd := bufio.NewReader(src)
+func (p *Proxy) responseFaulter(s *session, logger Logger) {
+	srcRd := bufio.NewReader(s.upstream)
 
 	for {
-		var buf []byte
-		var msg redcon.RESP
-		// Read a complete RESP command and preserve any extra data (will be part of the next packet)
-		for {
-			line, err := srcRd.ReadBytes('\n')
-			if err != nil {
+		msg, err := readMessage(srcRd)
+		if err != nil {
+			if err != io.EOF {
 				log.Println(err)
-				if err == io.EOF || err == os.ErrClosed {
-					return
-				}
 			}
+			return
+		}
+
+		p.plan.handleClientSetName(s.ClientAddr, msg)
 
-			buf = append(buf, line...)
-			n, resp := redcon.ReadNextRESP(buf)
-			if n != 0 {
-				msg = resp
-				break
+		// RESP3 push messages aren't replies to a request, they get their own rules
+		if msg.Type == Push {
+			if p.sentinel != nil {
+				msg = p.sentinel.rewrite(s, "", msg, logger)
 			}
+			rule := p.plan.SelectRule("PUSH", p.plan.Rules(PushStream), &s.ConnInfo, msg, logger)
+			p.handleProxyActions(rule, logger)
+			p.plan.handleRule("PUSH", msg, rule, s, logger)
+
+			// RESP3 clients get subscription confirmations as push messages too
+			err = s.replied(msg)
+			if err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		pending := s.nextReply(msg)
+		if p.cluster != nil {
+			msg = p.cluster.rewrite(s, pending.command, msg, logger)
+		}
+		if p.sentinel != nil {
+			msg = p.sentinel.rewrite(s, pending.command, msg, logger)
 		}
 
-		clientAddr := dst.RemoteAddr().String()
-		p.plan.handleClientSetName(clientAddr, msg)
-		rule := p.plan.SelectRule("RESPONSE", p.plan.ResponseRules, clientAddr, msg, logger)
+		info := s.ConnInfo
+		if !pending.queued {
+			// +QUEUED acknowledgements don't match the command they acknowledge, its result comes with EXEC
+			info.Request = pending.request
+		}
+		info.Transaction = pending.transaction
+		rule := p.plan.SelectRule("RESPONSE", p.plan.Rules(ResponseStream), &info, msg, logger)
+		p.handleProxyActions(rule, logger)
 
 		// if p.plan.MsgOrdering == "unordered" || (rule != nil && p.plan.MsgOrdering == "unordered-delays" && rule.Delay > 0) {
-		// 	go p.plan.handleRule("RESPONSE", msg, rule, src, dst, logger)
+		// 	go p.plan.handleRule("RESPONSE", msg, rule, s, logger)
 		// } else {
-		p.plan.handleRule("RESPONSE", msg, rule, src, dst, logger)
+		p.plan.handleRule("RESPONSE", msg, rule, s, logger)
 		// }
+
+		err = s.replied(msg)
+		if err != nil {
+			log.Println(err)
+		}
 	}
 }
@@ -0,0 +1,347 @@
+package redfi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// fakeRedis answers every command with its last argument as a simple string, after a short delay.
+// Pub/sub commands are confirmed once per channel, with push messages after HELLO 3.
+func fakeRedis(t *testing.T, addr string) net.Listener {
+	ln, err := listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				// confirmations are push messages once the client switched to RESP3
+				confirmation := redcon.Type(redcon.Array)
+				subscriptions := 0
+				for {
+					msg, err := readMessage(rd)
+					if err != nil {
+						return
+					}
+					args, _ := respArrToSlice(msg)
+					time.Sleep(10 * time.Millisecond)
+
+					command := rlower(args[0])
+					if command == "hello" && string(args[len(args)-1].Data) == "3" {
+						confirmation = redcon.Type(Push)
+					}
+					if _, ok := subscribeCommands[command]; ok && len(args) > 1 {
+						out := []byte{}
+						for _, channel := range args[1:] {
+							if subscribeCommands[command] == command {
+								subscriptions++
+							} else {
+								subscriptions--
+							}
+							out = appendAggregate(out, confirmation, 3)
+							out = redcon.AppendBulkString(out, command)
+							out = redcon.AppendBulk(out, channel.Data)
+							out = redcon.AppendInt(out, int64(subscriptions))
+						}
+						conn.Write(out)
+						continue
+					}
+					conn.Write([]byte("+" + string(args[len(args)-1].Data) + "\r\n"))
+				}
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestProxyUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	redisAddr := "unix:" + filepath.Join(dir, "redis.sock")
+	proxyAddr := "unix:" + filepath.Join(dir, "redfi.sock")
+
+	redis := fakeRedis(t, redisAddr)
+	defer redis.Close()
+
+	rule := &Rule{Name: "unix", ClientAddr: proxyAddr + "#", Delay: 1}
+	p, err := New("", redisAddr, proxyAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.plan.RequestRules = []*Rule{rule}
+
+	ln, err := listen(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go p.serve(ln, redisAddr, MakeLogger(-1))
+
+	network, address := splitAddr(proxyAddr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Raw) != "+PING\r\n" {
+		t.Fatalf("unexpected reply: %q", reply.Raw)
+	}
+
+	if atomic.LoadUint64(&rule.hits) != 1 {
+		t.Fatal("rule matching the unix socket client wasn't applied")
+	}
+}
+
+func TestProxyShortCircuit(t *testing.T) {
+	dir := t.TempDir()
+	redisAddr := "unix:" + filepath.Join(dir, "redis.sock")
+	proxyAddr := "unix:" + filepath.Join(dir, "redfi.sock")
+
+	redis := fakeRedis(t, redisAddr)
+	defer redis.Close()
+
+	p, err := New("", redisAddr, proxyAddr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.plan.RequestRules = []*Rule{
+		{Name: "err", RawMatchAll: []string{"short"}, ReturnErr: "ERR short-circuited"},
+		{Name: "empty", RawMatchAll: []string{"empty"}, ReturnEmpty: true},
+	}
+
+	ln, err := listen(proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go p.serve(ln, redisAddr, MakeLogger(-1))
+
+	network, address := splitAddr(proxyAddr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// pipeline every request, the short-circuited ones must not overtake the ones sent to redis
+	pipeline := ""
+	for _, key := range []string{"a", "short", "b", "empty", "short"} {
+		pipeline += fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	}
+	_, err = conn.Write([]byte(pipeline))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd := bufio.NewReader(conn)
+	for _, expected := range []string{"+a\r\n", "-ERR short-circuited\r\n", "+b\r\n", "$-1\r\n", "-ERR short-circuited\r\n"} {
+		reply, err := readMessage(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.Raw) != expected {
+			t.Fatalf("unexpected reply: expected = %q, output = %q", expected, reply.Raw)
+		}
+	}
+}
+
+func TestProxyShortCircuitSubscribe(t *testing.T) {
+	cases := []struct {
+		name     string
+		pipeline []string
+		expected []string
+	}{
+		{
+			name:     "RESP2",
+			pipeline: []string{"SUBSCRIBE a b", "PING short", "UNSUBSCRIBE a", "PING c"},
+			expected: []string{
+				"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n",
+				"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n",
+				"-ERR short-circuited\r\n",
+				"*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n",
+				"+c\r\n",
+			},
+		},
+		{
+			name:     "RESP3",
+			pipeline: []string{"HELLO 3", "SSUBSCRIBE a b", "PING short", "SUNSUBSCRIBE a", "PING c"},
+			expected: []string{
+				"+3\r\n",
+				">3\r\n$10\r\nssubscribe\r\n$1\r\na\r\n:1\r\n",
+				">3\r\n$10\r\nssubscribe\r\n$1\r\nb\r\n:2\r\n",
+				"-ERR short-circuited\r\n",
+				">3\r\n$12\r\nsunsubscribe\r\n$1\r\na\r\n:1\r\n",
+				"+c\r\n",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		_, conn := rulesProxy(t, []*Rule{
+			{Name: "err", RawMatchAll: []string{"short"}, ReturnErr: "ERR short-circuited"},
+		}, nil)
+
+		// the short-circuited reply waits for every confirmation of the subscribe before it
+		pipeline := []byte{}
+		for _, cmd := range c.pipeline {
+			pipeline = append(pipeline, command(cmd).Raw...)
+		}
+		_, err := conn.Write(pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rd := bufio.NewReader(conn)
+		for _, expected := range c.expected {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			reply, err := readMessage(rd)
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\terror    = %s", c.name, expected, err))
+			}
+			if string(reply.Raw) != expected {
+				t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, expected, reply.Raw))
+			}
+		}
+	}
+}
+
+func TestProxyResponseRuleAfterSubscribe(t *testing.T) {
+	_, conn := rulesProxy(t, nil, []*Rule{
+		{Name: "ping", Command: "PING", ReturnErr: "ERR replaced"},
+	})
+
+	// every confirmation is matched against the subscribe, only the reply to PING is replaced
+	pipeline := append(command("SUBSCRIBE a b").Raw, command("PING c").Raw...)
+	_, err := conn.Write(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd := bufio.NewReader(conn)
+	for _, expected := range []string{
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n",
+		"-ERR replaced\r\n",
+	} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply, err := readMessage(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.Raw) != expected {
+			t.Fatalf("unexpected reply: expected = %q, output = %q", expected, reply.Raw)
+		}
+	}
+}
+
+func TestProxyResponseRuleTransaction(t *testing.T) {
+	_, conn := rulesProxy(t, nil, []*Rule{
+		{Name: "get", Command: "GET", ReturnErr: "ERR replaced"},
+	})
+
+	// the fake redis acknowledges queued commands with their last argument instead of +QUEUED
+	pipeline := []byte{}
+	for _, cmd := range []string{"MULTI", "GET a", "EXEC"} {
+		pipeline = append(pipeline, command(cmd).Raw...)
+	}
+	_, err := conn.Write(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the reply to EXEC, which holds the result of GET, is replaced
+	rd := bufio.NewReader(conn)
+	for _, expected := range []string{"+MULTI\r\n", "+a\r\n", "-ERR replaced\r\n"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply, err := readMessage(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.Raw) != expected {
+			t.Fatalf("unexpected reply: expected = %q, output = %q", expected, reply.Raw)
+		}
+	}
+}
+
+func TestSessionUnsubscribeAll(t *testing.T) {
+	s := &session{}
+	for _, req := range []string{"SUBSCRIBE a b", "PSUBSCRIBE p*", "UNSUBSCRIBE", "UNSUBSCRIBE", "GET c"} {
+		s.expectReply(command(req))
+	}
+
+	// unsubscribing from everything is confirmed once per channel, or once without any channel left
+	for _, reply := range []string{
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n",
+		"*3\r\n$10\r\npsubscribe\r\n$2\r\np*\r\n:3\r\n",
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:2\r\n",
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n",
+		"*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:1\r\n",
+	} {
+		s.replied(Resp([]byte(reply)))
+	}
+
+	// messages published to the remaining pattern aren't replies
+	message := Resp([]byte("*4\r\n$8\r\npmessage\r\n$2\r\np*\r\n$2\r\npa\r\n$1\r\nm\r\n"))
+	if pending := s.nextReply(message); pending.command != "" {
+		t.Fatalf("message answered a request: %s", pending.command)
+	}
+	s.replied(message)
+
+	pending := s.nextReply(Resp([]byte("+c\r\n")))
+	if pending.command != "get" {
+		t.Fatalf("unexpected pending reply: expected = get, output = %s", pending.command)
+	}
+}
+
+func TestSessionTransaction(t *testing.T) {
+	s := &session{}
+	for _, req := range []string{
+		"*1\r\n$5\r\nMULTI\r\n",
+		"*2\r\n$4\r\nINCR\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n",
+		"*1\r\n$4\r\nEXEC\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nc\r\n",
+	} {
+		s.expectReply(Resp([]byte(req)))
+	}
+
+	expected := []struct {
+		command     string
+		transaction int
+	}{
+		{"multi", 0}, {"incr", 0}, {"get", 0}, {"exec", 2}, {"get", 0},
+	}
+	for _, e := range expected {
+		reply := Resp([]byte("+OK\r\n"))
+		pending := s.nextReply(reply)
+		if pending.command != e.command || len(pending.transaction) != e.transaction {
+			t.Fatalf("unexpected pending reply: expected = %s/%d, output = %s/%d", e.command, e.transaction, pending.command, len(pending.transaction))
+		}
+		s.replied(reply)
+	}
+}
@@ -0,0 +1,233 @@
+package redfi
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/tidwall/redcon"
+)
+
+// ReplyValue describes a RESP value in JSON, for rules to answer with.
+// Values that are strings are templates, executed against a replyContext.
+type ReplyValue struct {
+	// one of the keys of replyTypes
+	Type  string      `json:"type"`
+	Value interface{} `json:"value,omitempty"`
+	// verbatim strings only, "txt" by default
+	Format string `json:"format,omitempty"`
+	// array, set and push
+	Elements []*ReplyValue `json:"elements,omitempty"`
+	// map, each entry holds a key and a value
+	Entries [][2]*ReplyValue `json:"entries,omitempty"`
+
+	tmpl *template.Template
+}
+
+// replyTypes maps the types of ReplyValue to RESP types
+var replyTypes = map[string]redcon.Type{
+	"string":    redcon.String,
+	"error":     redcon.Error,
+	"integer":   redcon.Integer,
+	"bulk":      redcon.Bulk,
+	"nullBulk":  redcon.Bulk,
+	"array":     redcon.Array,
+	"nullArray": redcon.Array,
+	"null":      Null,
+	"double":    Double,
+	"boolean":   Boolean,
+	"bigNumber": BigNumber,
+	"blobError": BlobError,
+	"verbatim":  Verbatim,
+	"map":       Map,
+	"set":       Set,
+	"push":      Push,
+}
+
+// replyContext is what the templates of a reply are executed against
+type replyContext struct {
+	// lowercase command name
+	Command string
+	// arguments of the command, the command name excluded
+	Args []string
+	Keys []string
+}
+
+func newReplyContext(req redcon.RESP) *replyContext {
+	ctx := &replyContext{Args: []string{}, Keys: []string{}}
+
+	args, err := respArrToSlice(req)
+	if err != nil || len(args) == 0 {
+		return ctx
+	}
+
+	ctx.Command = strings.ToLower(string(args[0].Data))
+	for _, arg := range args[1:] {
+		ctx.Args = append(ctx.Args, string(arg.Data))
+	}
+	for _, key := range commandKeys(req) {
+		ctx.Keys = append(ctx.Keys, string(key))
+	}
+	return ctx
+}
+
+// compile checks a reply and its nested values, and parses their templates
+func (v *ReplyValue) compile(ruleName string) error {
+	if _, ok := replyTypes[v.Type]; !ok {
+		return fmt.Errorf("reply in rule '%s' is malformed, unknown type '%s'", ruleName, v.Type)
+	}
+
+	if s, ok := v.Value.(string); ok {
+		tmpl, err := template.New(ruleName).Option("missingkey=error").Parse(s)
+		if err != nil {
+			return fmt.Errorf("reply in rule '%s' is malformed: %s", ruleName, err)
+		}
+		v.tmpl = tmpl
+	}
+
+	nested := append([]*ReplyValue{}, v.Elements...)
+	for _, entry := range v.Entries {
+		nested = append(nested, entry[0], entry[1])
+	}
+	for _, elem := range nested {
+		if elem == nil {
+			return fmt.Errorf("reply in rule '%s' is malformed, missing value in '%s'", ruleName, v.Type)
+		}
+		err := elem.compile(ruleName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// templated reports whether the value, or any nested value, depends on the request, callers must compile the value first
+func (v *ReplyValue) templated() bool {
+	if v.tmpl != nil && v.tmpl.Tree != nil {
+		for _, node := range v.tmpl.Tree.Root.Nodes {
+			if node.Type() != parse.NodeText {
+				return true
+			}
+		}
+	}
+
+	for _, elem := range v.Elements {
+		if elem.templated() {
+			return true
+		}
+	}
+	for _, entry := range v.Entries {
+		if entry[0].templated() || entry[1].templated() {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns the value as a string, executing its template if any
+func (v *ReplyValue) render(ctx *replyContext) (string, error) {
+	switch value := v.Value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		buf := bytes.Buffer{}
+		err := v.tmpl.Execute(&buf, ctx)
+		return buf.String(), err
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	}
+	return fmt.Sprint(v.Value), nil
+}
+
+// appendReply appends the RESP encoding of the value
+func (v *ReplyValue) appendReply(b []byte, ctx *replyContext) ([]byte, error) {
+	s, err := v.render(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v.Type {
+	case "string":
+		return redcon.AppendString(b, s), nil
+	case "error":
+		return redcon.AppendError(b, s), nil
+	case "integer":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't an integer", s)
+		}
+		return redcon.AppendInt(b, n), nil
+	case "bulk":
+		return redcon.AppendBulkString(b, s), nil
+	case "nullBulk":
+		return append(b, "$-1\r\n"...), nil
+	case "nullArray":
+		return append(b, "*-1\r\n"...), nil
+	case "null":
+		return append(b, "_\r\n"...), nil
+	case "double":
+		_, err := strconv.ParseFloat(s, 64)
+		if err != nil && s != "inf" && s != "-inf" && s != "nan" {
+			return nil, fmt.Errorf("'%s' isn't a double", s)
+		}
+		return appendLine(b, Double, s), nil
+	case "boolean":
+		t, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't a boolean", s)
+		}
+		if t {
+			return appendLine(b, Boolean, "t"), nil
+		}
+		return appendLine(b, Boolean, "f"), nil
+	case "bigNumber":
+		return appendLine(b, BigNumber, s), nil
+	case "blobError":
+		return appendBlob(b, BlobError, s), nil
+	case "verbatim":
+		format := v.Format
+		if len(format) == 0 {
+			format = "txt"
+		}
+		return appendBlob(b, Verbatim, format+":"+s), nil
+	case "map":
+		b = appendAggregate(b, Map, len(v.Entries)*2)
+		for _, entry := range v.Entries {
+			for _, elem := range entry {
+				b, err = elem.appendReply(b, ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return b, nil
+	}
+
+	// array, set and push
+	b = appendAggregate(b, replyTypes[v.Type], len(v.Elements))
+	for _, elem := range v.Elements {
+		b, err = elem.appendReply(b, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendLine(b []byte, typ redcon.Type, s string) []byte {
+	b = append(b, byte(typ))
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+func appendBlob(b []byte, typ redcon.Type, s string) []byte {
+	b = append(b, byte(typ))
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, '\r', '\n')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
@@ -0,0 +1,95 @@
+package redfi
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestSyntheticReply(t *testing.T) {
+	cases := []struct {
+		name     string
+		reply    string
+		command  string
+		expected string
+	}{
+		{name: "simple string", reply: `{"type": "string", "value": "OK"}`, command: "SET a 1", expected: "+OK\r\n"},
+		{name: "integer", reply: `{"type": "integer", "value": 42}`, command: "INCR a", expected: ":42\r\n"},
+		{name: "null bulk", reply: `{"type": "nullBulk"}`, command: "GET a", expected: "$-1\r\n"},
+		{name: "null array", reply: `{"type": "nullArray"}`, command: "BLPOP a 1", expected: "*-1\r\n"},
+		{
+			name:     "templated bulk",
+			reply:    `{"type": "bulk", "value": "value of {{index .Args 0}}"}`,
+			command:  "GET user:1",
+			expected: "$15\r\nvalue of user:1\r\n",
+		},
+		{
+			name:     "templated integer",
+			reply:    `{"type": "integer", "value": "{{len .Keys}}"}`,
+			command:  "DEL a b c",
+			expected: ":3\r\n",
+		},
+		{
+			name: "nested arrays",
+			reply: `{"type": "array", "elements": [
+				{"type": "bulk", "value": "{{.Command}}"},
+				{"type": "array", "elements": [{"type": "integer", "value": 1}, {"type": "nullBulk"}]}
+			]}`,
+			command:  "GET a",
+			expected: "*2\r\n$3\r\nget\r\n*2\r\n:1\r\n$-1\r\n",
+		},
+		{
+			name: "RESP3 types",
+			reply: `{"type": "map", "entries": [
+				[{"type": "string", "value": "ratio"}, {"type": "double", "value": 1.5}],
+				[{"type": "string", "value": "ok"}, {"type": "boolean", "value": true}],
+				[{"type": "string", "value": "members"}, {"type": "set", "elements": [{"type": "null"}, {"type": "bigNumber", "value": "12345678901234567890"}]}],
+				[{"type": "string", "value": "text"}, {"type": "verbatim", "value": "hi"}]
+			]}`,
+			command:  "HELLO 3",
+			expected: "%4\r\n+ratio\r\n,1.5\r\n+ok\r\n#t\r\n+members\r\n~2\r\n_\r\n(12345678901234567890\r\n+text\r\n=6\r\ntxt:hi\r\n",
+		},
+		{name: "blob error", reply: `{"type": "blobError", "value": "SYNTAX oops"}`, command: "GET a", expected: "!11\r\nSYNTAX oops\r\n"},
+		{
+			name:     "failing template answers with an error",
+			reply:    `{"type": "integer", "value": "{{index .Args 0}}"}`,
+			command:  "GET a",
+			expected: "-ERR redfi: reply of rule 'reply' failed: 'a' isn't an integer\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		rule := &Rule{Name: "reply", Reply: &ReplyValue{}}
+		err := json.Unmarshal([]byte(c.reply), rule.Reply)
+		if err == nil {
+			err = rule.validate()
+		}
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\terror = %s", c.name, err))
+		}
+
+		output := string(rule.syntheticReply(command(c.command)))
+		if output != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, c.expected, output))
+		}
+	}
+}
+
+func TestReplyMalformed(t *testing.T) {
+	cases := []string{
+		`{"type": "tuple"}`,
+		`{"type": "bulk", "value": "{{.Args"}`,
+		`{"type": "array", "elements": [{"type": "bulk"}, {"type": "nope"}]}`,
+	}
+
+	for _, c := range cases {
+		rule := &Rule{Name: "reply", Reply: &ReplyValue{}}
+		err := json.Unmarshal([]byte(c), rule.Reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.validate() == nil {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected an error", c))
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package redfi
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+
+	"github.com/tidwall/redcon"
+)
+
+// RESP3 kinds, redcon only knows about the RESP2 ones
+const (
+	Null      = '_'
+	Double    = ','
+	Boolean   = '#'
+	BigNumber = '('
+	BlobError = '!'
+	Verbatim  = '='
+	Map       = '%'
+	Set       = '~'
+	Attribute = '|'
+	Push      = '>'
+)
+
+// ReadNextRESP is a RESP3-aware version of redcon.ReadNextRESP.
+// It returns the next message in b and the number of bytes it took up,
+// or 0 if b doesn't hold a complete message yet.
+//
+// Aggregates keep their elements in Data, and Count holds the number of elements,
+// which for maps and attributes is twice the number of pairs.
+// An attribute is framed together with the reply it annotates:
+// the returned message is the reply, and its Raw includes the attribute.
+func ReadNextRESP(b []byte) (n int, resp redcon.RESP) {
+	if len(b) == 0 {
+		return 0, redcon.RESP{} // no data to read
+	}
+
+	// read to end of line
+	i := bytes.IndexByte(b, '\n')
+	if i < 2 || b[i-1] != '\r' {
+		return 0, redcon.RESP{} // not enough data, or missing CR character
+	}
+
+	resp.Type = redcon.Type(b[0])
+	resp.Raw = b[:i+1]
+	resp.Data = b[1 : i-1]
+
+	switch resp.Type {
+	case redcon.Integer, redcon.String, redcon.Error, Null, Double, Boolean, BigNumber:
+		return len(resp.Raw), resp
+
+	case redcon.Bulk, BlobError, Verbatim:
+		count, err := strconv.Atoi(string(resp.Data))
+		if err != nil {
+			return 0, redcon.RESP{} // invalid number of bytes
+		}
+		if count < 0 {
+			// RESP2 null bulk string
+			resp.Data = nil
+			return len(resp.Raw), resp
+		}
+
+		end := i + 1 + count
+		if len(b) < end+2 {
+			return 0, redcon.RESP{} // not enough data
+		}
+		if b[end] != '\r' || b[end+1] != '\n' {
+			return 0, redcon.RESP{} // invalid end of line
+		}
+
+		resp.Data = b[i+1 : end]
+		resp.Raw = b[:end+2]
+		return len(resp.Raw), resp
+
+	case redcon.Array, Set, Push, Map, Attribute:
+		count, err := strconv.Atoi(string(resp.Data))
+		if err != nil {
+			return 0, redcon.RESP{} // invalid number of elements
+		}
+		if count < 0 {
+			// RESP2 null array
+			resp.Data = nil
+			return len(resp.Raw), resp
+		}
+		if resp.Type == Map || resp.Type == Attribute {
+			count *= 2
+		}
+
+		off := i + 1
+		for j := 0; j < count; j++ {
+			rn, _ := ReadNextRESP(b[off:])
+			if rn == 0 {
+				return 0, redcon.RESP{}
+			}
+			off += rn
+		}
+
+		resp.Count = count
+		resp.Data = b[i+1 : off]
+		resp.Raw = b[:off]
+
+		if resp.Type == Attribute {
+			// an attribute annotates the reply that follows it
+			rn, reply := ReadNextRESP(b[off:])
+			if rn == 0 {
+				return 0, redcon.RESP{}
+			}
+			reply.Raw = b[:off+rn]
+			return len(reply.Raw), reply
+		}
+
+		return len(resp.Raw), resp
+	}
+
+	return 0, redcon.RESP{} // invalid kind
+}
+
+// forEachRESP iterates over each element of an aggregate,
+// it replaces redcon's RESP.ForEach, which can't read RESP3 elements
+func forEachRESP(resp redcon.RESP, iter func(resp redcon.RESP) bool) {
+	data := resp.Data
+	for i := 0; i < resp.Count; i++ {
+		n, elem := ReadNextRESP(data)
+		if n == 0 || !iter(elem) {
+			return
+		}
+		data = data[n:]
+	}
+}
+
+// readMessage reads a complete RESP message,
+// any extra data is left in rd and will be part of the next message
+func readMessage(rd *bufio.Reader) (redcon.RESP, error) {
+	var buf []byte
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			return redcon.RESP{}, err
+		}
+
+		buf = append(buf, line...)
+		n, resp := ReadNextRESP(buf)
+		if n != 0 {
+			return resp, nil
+		}
+	}
+}
+
+// forEachPair iterates over the key/value pairs of a map,
+// or of a RESP2 array holding keys and values one after the other
+func forEachPair(resp redcon.RESP, iter func(key, val redcon.RESP) bool) {
+	var key redcon.RESP
+	n := 0
+	forEachRESP(resp, func(elem redcon.RESP) bool {
+		n++
+		if n%2 == 1 {
+			key = elem
+			return true
+		}
+		return iter(key, elem)
+	})
+}
+
+// appendAggregate appends the header of an aggregate holding count elements
+func appendAggregate(b []byte, typ redcon.Type, count int) []byte {
+	if typ == Map || typ == Attribute {
+		count /= 2
+	}
+	b = append(b, byte(typ))
+	b = strconv.AppendInt(b, int64(count), 10)
+	return append(b, '\r', '\n')
+}
@@ -0,0 +1,123 @@
+package redfi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestReadNextRESP(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		n     int
+		typ   redcon.Type
+		count int
+		data  string
+	}{
+		{
+			name:  "RESP2 array",
+			input: "*2\r\n$3\r\nget\r\n$3\r\nfoo\r\n",
+			n:     22,
+			typ:   redcon.Array,
+			count: 2,
+			data:  "$3\r\nget\r\n$3\r\nfoo\r\n",
+		},
+		{
+			name:  "RESP2 null bulk string",
+			input: "$-1\r\n",
+			n:     5,
+			typ:   redcon.Bulk,
+		},
+		{
+			name:  "map counts keys and values",
+			input: "%2\r\n+a\r\n:1\r\n+b\r\n,1.5\r\n",
+			n:     22,
+			typ:   Map,
+			count: 4,
+			data:  "+a\r\n:1\r\n+b\r\n,1.5\r\n",
+		},
+		{
+			name:  "set with nested RESP3 values",
+			input: "~3\r\n_\r\n#t\r\n(12345678901234567890\r\n",
+			n:     34,
+			typ:   Set,
+			count: 3,
+			data:  "_\r\n#t\r\n(12345678901234567890\r\n",
+		},
+		{
+			name:  "verbatim string",
+			input: "=9\r\ntxt:hello\r\n",
+			n:     15,
+			typ:   Verbatim,
+			data:  "txt:hello",
+		},
+		{
+			name:  "push message",
+			input: ">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n",
+			n:     34,
+			typ:   Push,
+			count: 2,
+			data:  "$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n",
+		},
+		{
+			name:  "attribute is framed with the reply it annotates",
+			input: "|1\r\n+ttl\r\n:10\r\n$3\r\nbar\r\n",
+			n:     24,
+			typ:   redcon.Bulk,
+			data:  "bar",
+		},
+		{
+			name:  "incomplete map",
+			input: "%2\r\n+a\r\n:1\r\n+b\r\n",
+			n:     0,
+		},
+	}
+
+	for _, c := range cases {
+		n, resp := ReadNextRESP([]byte(c.input))
+		if n != c.n || resp.Type != c.typ || resp.Count != c.count || string(resp.Data) != c.data {
+			t.Fatal(fmt.Sprintf(
+				"Case failed:\n\t%s:\n\texpected = n=%d type=%q count=%d data=%q\n\toutput   = n=%d type=%q count=%d data=%q",
+				c.name,
+				c.n, c.typ, c.count, c.data,
+				n, resp.Type, resp.Count, resp.Data,
+			))
+		}
+		if n > 0 && string(resp.Raw) != c.input[:n] {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\traw = %q", c.name, resp.Raw))
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	rd := bufio.NewReader(bytes.NewBufferString("%1\r\n$3\r\nfoo\r\n$4\r\nb\r\nr\r\n>1\r\n+x\r\n"))
+
+	msg, err := readMessage(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != Map || msg.Count != 2 {
+		t.Fatal(fmt.Sprintf("unexpected first message: %q", msg.Raw))
+	}
+
+	values := []string{}
+	forEachRESP(msg, func(r redcon.RESP) bool {
+		values = append(values, string(r.Data))
+		return true
+	})
+	if len(values) != 2 || values[0] != "foo" || values[1] != "b\r\nr" {
+		t.Fatal(fmt.Sprintf("unexpected map elements: %q", values))
+	}
+
+	msg, err = readMessage(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != Push {
+		t.Fatal(fmt.Sprintf("unexpected second message: %q", msg.Raw))
+	}
+}
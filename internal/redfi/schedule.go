@@ -0,0 +1,109 @@
+package redfi
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ScheduleFromStart times scheduled rules from the start of the proxy
+	ScheduleFromStart = "start"
+	// ScheduleFromTrigger times scheduled rules from the last trigger through the control API,
+	// they stay inactive until then
+	ScheduleFromTrigger = "trigger"
+)
+
+// Schedule repeatedly turns a rule on then off, starting with on
+type Schedule struct {
+	// milliseconds the rule is active, then inactive, in each period
+	On  int `json:"on"`
+	Off int `json:"off"`
+}
+
+// ScheduleState is where the schedule of the rules is at
+type ScheduleState struct {
+	From string `json:"from"`
+	// nil until triggered
+	Started *time.Time `json:"started,omitempty"`
+	// milliseconds since the schedule started
+	Elapsed int64 `json:"elapsed"`
+}
+
+func validateSchedule(r *Rule) error {
+	if r.StartAfter < 0 || r.Duration < 0 {
+		return fmt.Errorf("rule '%s' is malformed, startAfter and duration can't be negative", r.Name)
+	}
+	if r.Schedule != nil && (r.Schedule.On <= 0 || r.Schedule.Off < 0) {
+		return fmt.Errorf("schedule in rule '%s' is malformed, on must be positive and off can't be negative", r.Name)
+	}
+	return nil
+}
+
+// scheduled reports whether a rule is only active at times
+func (r *Rule) scheduled() bool {
+	return r.StartAfter > 0 || r.Duration > 0 || r.Schedule != nil
+}
+
+// activeAt reports whether a scheduled rule is active the given time after the schedule started
+func (r *Rule) activeAt(elapsed time.Duration) bool {
+	ms := int(elapsed / time.Millisecond)
+	if ms < r.StartAfter {
+		return false
+	}
+	ms -= r.StartAfter
+
+	if r.Duration > 0 && ms >= r.Duration {
+		return false
+	}
+	if r.Schedule != nil {
+		return ms%(r.Schedule.On+r.Schedule.Off) < r.Schedule.On
+	}
+	return true
+}
+
+// active reports whether a rule applies right now
+func (p *Plan) active(rule *Rule) bool {
+	if !rule.scheduled() {
+		return true
+	}
+
+	p.m.RLock()
+	epoch := p.epoch
+	p.m.RUnlock()
+
+	if epoch.IsZero() {
+		return false
+	}
+	return rule.activeAt(time.Since(epoch))
+}
+
+// TriggerSchedule starts the schedule of the rules over, from now
+func (p *Plan) TriggerSchedule() ScheduleState {
+	p.m.Lock()
+	p.epoch = time.Now()
+	p.m.Unlock()
+
+	return p.ScheduleState()
+}
+
+// scheduleFrom returns what the scheduled rules are timed from, callers must hold p.m
+func (p *Plan) scheduleFrom() string {
+	if len(p.ScheduleFrom) == 0 {
+		return ScheduleFromStart
+	}
+	return p.ScheduleFrom
+}
+
+// ScheduleState returns where the schedule of the rules is at
+func (p *Plan) ScheduleState() ScheduleState {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	state := ScheduleState{From: p.scheduleFrom()}
+	if !p.epoch.IsZero() {
+		started := p.epoch
+		state.Started = &started
+		state.Elapsed = int64(time.Since(started) / time.Millisecond)
+	}
+	return state
+}
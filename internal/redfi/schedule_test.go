@@ -0,0 +1,162 @@
+package redfi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleActiveAt(t *testing.T) {
+	// healthy for a minute, then 30 seconds of outage, then recovery
+	outage := Rule{StartAfter: 60000, Duration: 30000}
+	// on 10s, off 50s
+	flapping := Rule{Schedule: &Schedule{On: 10000, Off: 50000}}
+	// flapping during the outage only
+	flappingOutage := Rule{StartAfter: 60000, Duration: 30000, Schedule: &Schedule{On: 1000, Off: 4000}}
+
+	cases := []struct {
+		name     string
+		rule     Rule
+		elapsed  time.Duration
+		expected bool
+	}{
+		{name: "before start", rule: outage, elapsed: 59 * time.Second, expected: false},
+		{name: "started", rule: outage, elapsed: 60 * time.Second, expected: true},
+		{name: "last moment", rule: outage, elapsed: 90*time.Second - time.Millisecond, expected: true},
+		{name: "over", rule: outage, elapsed: 90 * time.Second, expected: false},
+		{name: "first on", rule: flapping, elapsed: 0, expected: true},
+		{name: "first off", rule: flapping, elapsed: 10 * time.Second, expected: false},
+		{name: "second on", rule: flapping, elapsed: 65 * time.Second, expected: true},
+		{name: "second off", rule: flapping, elapsed: 119 * time.Second, expected: false},
+		{name: "schedule from start", rule: flappingOutage, elapsed: 60500 * time.Millisecond, expected: true},
+		{name: "schedule off", rule: flappingOutage, elapsed: 62 * time.Second, expected: false},
+		{name: "schedule on again", rule: flappingOutage, elapsed: 65 * time.Second, expected: true},
+		{name: "schedule over", rule: flappingOutage, elapsed: 90 * time.Second, expected: false},
+	}
+
+	for _, c := range cases {
+		output := c.rule.activeAt(c.elapsed)
+		if output != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s at %s:\n\texpected = %t\n\toutput   = %t", c.name, c.elapsed, c.expected, output))
+		}
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{rule: Rule{StartAfter: 1000, Duration: 500}, expected: true},
+		{rule: Rule{Schedule: &Schedule{On: 10, Off: 50}}, expected: true},
+		{rule: Rule{StartAfter: -1}, expected: false},
+		{rule: Rule{Duration: -1}, expected: false},
+		{rule: Rule{Schedule: &Schedule{Off: 50}}, expected: false},
+		{rule: Rule{Schedule: &Schedule{On: 10, Off: -1}}, expected: false},
+	}
+
+	for i, c := range cases {
+		err := c.rule.validate()
+		if (err == nil) != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t#%d:\n\texpected valid = %t\n\toutput         = %v", i, c.expected, err))
+		}
+	}
+}
+
+func TestSelectRuleSchedule(t *testing.T) {
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	err := os.WriteFile(planPath, []byte(`{
+		"scheduleFrom": "trigger",
+		"requestRules": [
+			{"name": "outage", "startAfter": 50, "duration": 50, "alwaysMatch": true},
+			{"name": "always", "alwaysMatch": true}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Parse(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := func() string {
+		rule := p.SelectRule("REQUEST", p.Rules(RequestStream), &ConnInfo{}, command("GET a"), MakeLogger(-1))
+		if rule == nil {
+			return ""
+		}
+		return rule.Name
+	}
+
+	// scheduled rules wait for the trigger
+	if output := selected(); output != "always" {
+		t.Fatalf("rule selected before the trigger: %s", output)
+	}
+	if p.ScheduleState().Started != nil {
+		t.Fatal("schedule started before the trigger")
+	}
+
+	p.TriggerSchedule()
+	if output := selected(); output != "always" {
+		t.Fatalf("rule selected before its start: %s", output)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if output := selected(); output != "outage" {
+		t.Fatalf("rule wasn't selected once started: %s", output)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if output := selected(); output != "always" {
+		t.Fatalf("rule selected once over: %s", output)
+	}
+
+	// the trigger starts the schedule over
+	state := p.TriggerSchedule()
+	if state.From != ScheduleFromTrigger || state.Started == nil || state.Elapsed > 10 {
+		t.Fatalf("unexpected schedule state: %+v", state)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if output := selected(); output != "outage" {
+		t.Fatalf("rule wasn't selected once triggered again: %s", output)
+	}
+}
+
+func TestScheduleReload(t *testing.T) {
+	cases := []struct {
+		name string
+		from string
+		next string
+		// whether the reloaded plan keeps the schedule, or starts it over from the reload
+		keeps   bool
+		started bool
+	}{
+		{name: "start to start", from: ScheduleFromStart, next: "", keeps: true, started: true},
+		{name: "start to trigger", from: ScheduleFromStart, next: ScheduleFromTrigger, started: false},
+		{name: "trigger to start", from: ScheduleFromTrigger, next: ScheduleFromStart, started: true},
+	}
+
+	for _, c := range cases {
+		p, err := parsePlan(t, fmt.Sprintf(`{"scheduleFrom": "%s"}`, c.from))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := p.TriggerSchedule()
+		time.Sleep(10 * time.Millisecond)
+
+		next, err := parsePlan(t, fmt.Sprintf(`{"scheduleFrom": "%s"}`, c.next))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Replace(next)
+
+		state := p.ScheduleState()
+		kept := state.Started != nil && state.Started.Equal(*before.Started)
+		if kept != c.keeps || (state.Started != nil) != c.started {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = kept %t, started %t\n\toutput   = %+v", c.name, c.keeps, c.started, state))
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package redfi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// sentinel keeps one proxied listener per master and replica announced by a Redis Sentinel,
+// and rewrites the addresses in sentinel replies so clients only ever see those listeners
+type sentinel struct {
+	*nodeMap
+}
+
+// EnableSentinel makes the proxy front a Redis Sentinel, the redis address being the sentinel.
+// Every master and replica gets its own listener, on the listen host and the ports following the listen port.
+// announceHost is the host given to clients in rewritten replies, it defaults to the listen host.
+func (p *Proxy) EnableSentinel(announceHost string) error {
+	nodes, err := newNodeMap(p, announceHost)
+	if err != nil {
+		return err
+	}
+
+	p.sentinel = &sentinel{nodes}
+	return nil
+}
+
+// query sends a single command to the sentinel and returns its reply
+func (s *sentinel) query(args ...string) (redcon.RESP, error) {
+	conn, err := s.proxy.dial(s.proxy.redisAddr)
+	if err != nil {
+		return redcon.RESP{}, err
+	}
+	defer conn.Close()
+
+	buf := redcon.AppendArray(nil, len(args))
+	for _, arg := range args {
+		buf = redcon.AppendBulkString(buf, arg)
+	}
+	_, err = conn.Write(buf)
+	if err != nil {
+		return redcon.RESP{}, err
+	}
+
+	reply, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		return redcon.RESP{}, err
+	}
+	if reply.Type == redcon.Error {
+		return redcon.RESP{}, fmt.Errorf("%s", reply.Data)
+	}
+	return reply, nil
+}
+
+// discover starts a listener for every master known to the sentinel,
+// replicas get one as soon as they are first announced
+func (s *sentinel) discover(logger Logger) {
+	reply, err := s.query("SENTINEL", "MASTERS")
+	if err != nil {
+		logger(0, fmt.Sprintf("Failed to list the masters of the sentinel: %s\n", err))
+		return
+	}
+
+	sentinelHost, _, _ := net.SplitHostPort(s.proxy.redisAddr)
+	s.rewriteInfos(reply, sentinelHost, logger)
+}
+
+// masterAddr asks the sentinel for the address of the named master
+func (s *sentinel) masterAddr(name string) (string, error) {
+	reply, err := s.query("SENTINEL", "GET-MASTER-ADDR-BY-NAME", name)
+	if err != nil {
+		return "", err
+	}
+
+	args, err := respArrToSlice(reply)
+	if err != nil || len(args) != 2 {
+		return "", fmt.Errorf("unknown master '%s'", name)
+	}
+	return net.JoinHostPort(string(args[0].Data), string(args[1].Data)), nil
+}
+
+// failover simulates a failover of the named master: the master is announced on a new address,
+// the connections to its previous address are dropped and +switch-master is published to subscribers
+func (s *sentinel) failover(name string, logger Logger) {
+	upstreamAddr, err := s.masterAddr(name)
+	if err != nil {
+		logger(0, fmt.Sprintf("Failed to simulate failover of master '%s': %s\n", name, err))
+		return
+	}
+
+	prev, next := s.move(upstreamAddr, logger)
+	logger(0, fmt.Sprintf("Simulating failover of master '%s': %s -> %s\n", name, prev, next))
+
+	s.proxy.closeSessions(upstreamAddr)
+
+	prevHost, prevPort, _ := net.SplitHostPort(prev)
+	nextHost, nextPort, _ := net.SplitHostPort(next)
+	payload := strings.Join([]string{name, prevHost, prevPort, nextHost, nextPort}, " ")
+
+	s.proxy.sessionsM.Lock()
+	defer s.proxy.sessionsM.Unlock()
+
+	for sess := range s.proxy.sessions {
+		sess.m.Lock()
+		prefix, resp3 := sess.switchMaster, sess.resp3
+		sess.m.Unlock()
+		if len(prefix) == 0 {
+			continue
+		}
+		buf := switchMasterMessage(prefix, payload, resp3)
+
+		// writes to clients are serialized by the plan lock, or the session write lock for shaped ones,
+		// see Plan.handleRule
+		sess.w.Lock()
+		s.proxy.plan.m.Lock()
+		_, err := sess.client.Write(buf)
+		s.proxy.plan.m.Unlock()
+		sess.w.Unlock()
+		if err != nil {
+			logger(1, fmt.Sprintf("Failed to publish +switch-master to %s: %s\n", sess.ClientAddr, err))
+		}
+	}
+}
+
+// switchMasterMessage returns the +switch-master message published to a subscriber,
+// RESP3 clients get it as a push message
+func switchMasterMessage(prefix []string, payload string, resp3 bool) []byte {
+	typ := redcon.Type(redcon.Array)
+	if resp3 {
+		typ = Push
+	}
+
+	buf := appendAggregate(nil, typ, len(prefix)+2)
+	for _, arg := range append(prefix, "+switch-master", payload) {
+		buf = redcon.AppendBulkString(buf, arg)
+	}
+	return buf
+}
+
+// handleSubscribe remembers whether a client subscribed to +switch-master messages
+func (s *sentinel) handleSubscribe(sess *session, msg redcon.RESP) {
+	args, err := respArrToSlice(msg)
+	if err != nil || len(args) < 2 {
+		return
+	}
+
+	var prefix []string
+	switch rlower(args[0]) {
+	case "subscribe":
+		for _, arg := range args[1:] {
+			if string(arg.Data) == "+switch-master" {
+				prefix = []string{"message"}
+			}
+		}
+	case "psubscribe":
+		for _, arg := range args[1:] {
+			if match.Match("+switch-master", string(arg.Data)) {
+				prefix = []string{"pmessage", string(arg.Data)}
+			}
+		}
+	}
+
+	if prefix == nil {
+		return
+	}
+
+	sess.m.Lock()
+	sess.switchMaster = prefix
+	sess.m.Unlock()
+}
+
+// rewrite replaces node addresses in the given sentinel reply with proxied ones.
+// command is the name of the request the reply belongs to.
+func (s *sentinel) rewrite(sess *session, command string, msg redcon.RESP, logger Logger) redcon.RESP {
+	upstreamHost, _, _ := net.SplitHostPort(sess.UpstreamAddr)
+
+	var out []byte
+	switch command {
+	case "sentinel get-master-addr-by-name":
+		out = s.rewriteAddr(msg, upstreamHost, logger)
+	case "sentinel master":
+		out = s.rewriteInfo(nil, msg, upstreamHost, logger)
+	case "sentinel masters", "sentinel replicas", "sentinel slaves", "sentinel sentinels":
+		out = s.rewriteInfos(msg, upstreamHost, logger)
+	default:
+		out = s.rewriteSwitchMaster(msg, upstreamHost, logger)
+	}
+
+	if out == nil {
+		return msg
+	}
+
+	_, rewritten := ReadNextRESP(out)
+	logger(2, fmt.Sprintf("Rewrote sentinel reply: command = %s, reply = \"\n%s\n\"\n", command, clean(string(rewritten.Raw))))
+	return rewritten
+}
+
+// rewriteAddr rewrites a SENTINEL GET-MASTER-ADDR-BY-NAME reply, an [ip, port] array
+func (s *sentinel) rewriteAddr(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	args, err := respArrToSlice(msg)
+	if err != nil || len(args) != 2 {
+		return nil
+	}
+
+	addr := s.proxyAddr(resolve(net.JoinHostPort(string(args[0].Data), string(args[1].Data)), upstreamHost), logger)
+	host, port, _ := net.SplitHostPort(addr)
+
+	out := appendAggregate(nil, msg.Type, msg.Count)
+	out = redcon.AppendBulkString(out, host)
+	return redcon.AppendBulkString(out, port)
+}
+
+// rewriteInfos rewrites an array of the maps sent for SENTINEL MASTERS, REPLICAS and SENTINELS
+func (s *sentinel) rewriteInfos(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	if msg.Type != redcon.Array || msg.Data == nil {
+		return nil
+	}
+
+	out := appendAggregate(nil, msg.Type, msg.Count)
+	forEachRESP(msg, func(info redcon.RESP) bool {
+		out = s.rewriteInfo(out, info, upstreamHost, logger)
+		return true
+	})
+	return out
+}
+
+// rewriteInfo rewrites the ip and port of the map sent for a single master, replica or sentinel
+func (s *sentinel) rewriteInfo(out []byte, info redcon.RESP, upstreamHost string, logger Logger) []byte {
+	ip, port := "", ""
+	forEachPair(info, func(key, val redcon.RESP) bool {
+		switch rlower(key) {
+		case "ip":
+			ip = string(val.Data)
+		case "port":
+			port = string(val.Data)
+		}
+		return true
+	})
+
+	if len(port) == 0 || (info.Type != redcon.Array && info.Type != Map) {
+		return append(out, info.Raw...)
+	}
+
+	addr := s.proxyAddr(resolve(net.JoinHostPort(ip, port), upstreamHost), logger)
+	proxyHost, proxyPort, _ := net.SplitHostPort(addr)
+
+	out = appendAggregate(out, info.Type, info.Count)
+	forEachPair(info, func(key, val redcon.RESP) bool {
+		out = append(out, key.Raw...)
+		switch rlower(key) {
+		case "ip":
+			out = redcon.AppendBulkString(out, proxyHost)
+		case "port":
+			if val.Type == redcon.Integer {
+				n, _ := strconv.Atoi(proxyPort)
+				out = redcon.AppendInt(out, int64(n))
+			} else {
+				out = redcon.AppendBulkString(out, proxyPort)
+			}
+		default:
+			out = append(out, val.Raw...)
+		}
+		return true
+	})
+	return out
+}
+
+// rewriteSwitchMaster rewrites +switch-master messages published by the sentinel,
+// the payload looks like: <name> <old ip> <old port> <new ip> <new port>
+func (s *sentinel) rewriteSwitchMaster(msg redcon.RESP, upstreamHost string, logger Logger) []byte {
+	// RESP3 clients get pub/sub messages as push messages
+	if msg.Type != redcon.Array && msg.Type != Push {
+		return nil
+	}
+
+	args := []redcon.RESP{}
+	forEachRESP(msg, func(arg redcon.RESP) bool {
+		args = append(args, arg)
+		return true
+	})
+	if len(args) < 3 || string(args[len(args)-2].Data) != "+switch-master" {
+		return nil
+	}
+	if kind := rlower(args[0]); kind != "message" && kind != "pmessage" {
+		return nil
+	}
+
+	fields := strings.Fields(string(args[len(args)-1].Data))
+	if len(fields) != 5 {
+		return nil
+	}
+	for _, i := range []int{1, 3} {
+		addr := s.proxyAddr(resolve(net.JoinHostPort(fields[i], fields[i+1]), upstreamHost), logger)
+		fields[i], fields[i+1], _ = net.SplitHostPort(addr)
+	}
+
+	out := appendAggregate(nil, msg.Type, msg.Count)
+	for _, arg := range args[:len(args)-1] {
+		out = append(out, arg.Raw...)
+	}
+	return redcon.AppendBulkString(out, strings.Join(fields, " "))
+}
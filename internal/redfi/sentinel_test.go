@@ -0,0 +1,124 @@
+package redfi
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSentinelRewrite(t *testing.T) {
+	s := &sentinel{&nodeMap{
+		announceHost: "proxy",
+		nodes: map[string]string{
+			"10.0.0.1:6379": "proxy:6381",
+			"10.0.0.2:6379": "proxy:6382",
+		},
+	}}
+	sess := &session{ConnInfo: ConnInfo{UpstreamAddr: "10.0.0.9:26379"}}
+
+	cases := []struct {
+		name     string
+		command  string
+		reply    string
+		expected string
+	}{
+		{
+			name:     "master address",
+			command:  "sentinel get-master-addr-by-name",
+			reply:    "*2\r\n$8\r\n10.0.0.1\r\n$4\r\n6379\r\n",
+			expected: "*2\r\n$5\r\nproxy\r\n$4\r\n6381\r\n",
+		},
+		{
+			name:     "unknown master",
+			command:  "sentinel get-master-addr-by-name",
+			reply:    "*-1\r\n",
+			expected: "*-1\r\n",
+		},
+		{
+			name:     "replicas",
+			command:  "sentinel replicas",
+			reply:    "*1\r\n*6\r\n$4\r\nname\r\n$13\r\n10.0.0.2:6379\r\n$2\r\nip\r\n$8\r\n10.0.0.2\r\n$4\r\nport\r\n$4\r\n6379\r\n",
+			expected: "*1\r\n*6\r\n$4\r\nname\r\n$13\r\n10.0.0.2:6379\r\n$2\r\nip\r\n$5\r\nproxy\r\n$4\r\nport\r\n$4\r\n6382\r\n",
+		},
+		{
+			name:     "switch-master message",
+			command:  "",
+			reply:    "*3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$36\r\nmymaster 10.0.0.1 6379 10.0.0.2 6379\r\n",
+			expected: "*3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$30\r\nmymaster proxy 6381 proxy 6382\r\n",
+		},
+		{
+			name:     "other replies are untouched",
+			command:  "get",
+			reply:    "*2\r\n$8\r\n10.0.0.1\r\n$4\r\n6379\r\n",
+			expected: "*2\r\n$8\r\n10.0.0.1\r\n$4\r\n6379\r\n",
+		},
+	}
+
+	for _, c := range cases {
+		output := s.rewrite(sess, c.command, Resp3([]byte(c.reply)), MakeLogger(-1))
+		if string(output.Raw) != c.expected {
+			t.Fatal(fmt.Sprintf(
+				"Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q",
+				c.name,
+				c.expected,
+				output.Raw,
+			))
+		}
+	}
+}
+
+func TestSentinelHandleSubscribe(t *testing.T) {
+	s := &sentinel{&nodeMap{}}
+
+	sess := &session{}
+	s.handleSubscribe(sess, Resp([]byte("*2\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n")))
+	if len(sess.switchMaster) != 1 || sess.switchMaster[0] != "message" {
+		t.Fatal(fmt.Sprintf("unexpected subscription: %q", sess.switchMaster))
+	}
+
+	sess = &session{}
+	s.handleSubscribe(sess, Resp([]byte("*2\r\n$10\r\npsubscribe\r\n$1\r\n*\r\n")))
+	if len(sess.switchMaster) != 2 || sess.switchMaster[0] != "pmessage" || sess.switchMaster[1] != "*" {
+		t.Fatal(fmt.Sprintf("unexpected subscription: %q", sess.switchMaster))
+	}
+
+	sess = &session{}
+	s.handleSubscribe(sess, Resp([]byte("*2\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n")))
+	if sess.switchMaster != nil {
+		t.Fatal(fmt.Sprintf("unexpected subscription: %q", sess.switchMaster))
+	}
+}
+
+func TestSwitchMasterMessage(t *testing.T) {
+	cases := []struct {
+		name     string
+		hello    string
+		expected string
+	}{
+		{
+			name:     "RESP2",
+			expected: "*3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$30\r\nmymaster proxy 6381 proxy 6382\r\n",
+		},
+		{
+			name:     "RESP3",
+			hello:    "HELLO 3",
+			expected: ">3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$30\r\nmymaster proxy 6381 proxy 6382\r\n",
+		},
+		{
+			name:     "back to RESP2",
+			hello:    "HELLO 2",
+			expected: "*3\r\n$7\r\nmessage\r\n$14\r\n+switch-master\r\n$30\r\nmymaster proxy 6381 proxy 6382\r\n",
+		},
+	}
+
+	sess := &session{}
+	for _, c := range cases {
+		if len(c.hello) > 0 {
+			sess.handleHello(command(c.hello))
+		}
+
+		output := string(switchMasterMessage([]string{"message"}, "mymaster proxy 6381 proxy 6382", sess.resp3))
+		if output != c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = %q\n\toutput   = %q", c.name, c.expected, output))
+		}
+	}
+}
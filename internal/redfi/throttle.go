@@ -0,0 +1,95 @@
+package redfi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// ConnectionBandwidth gives each connection its own bandwidth
+	ConnectionBandwidth = "connection"
+	// SharedBandwidth shares the bandwidth across every connection matched by the rule
+	SharedBandwidth = "shared"
+)
+
+// throttle paces writes to a number of bytes per second
+type throttle struct {
+	rate int
+	// when the link is free to send more bytes
+	next time.Time
+	m    sync.Mutex
+}
+
+func newThrottle(rate int) *throttle {
+	return &throttle{rate: rate}
+}
+
+// reserve books the link for n bytes and returns how long to wait before sending them
+func (t *throttle) reserve(n int) time.Duration {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+	return wait
+}
+
+// chunkSize is how many bytes are written at once, about a tenth of a second worth of bandwidth
+func (t *throttle) chunkSize() int {
+	size := t.rate / 10
+	if size < 1 {
+		size = 1
+	}
+	if size > 16*1024 {
+		size = 16 * 1024
+	}
+	return size
+}
+
+func validateBandwidth(r *Rule) error {
+	if r.Bandwidth < 0 {
+		return fmt.Errorf("bandwidth in rule '%s' is malformed, it can't be negative", r.Name)
+	}
+
+	switch r.BandwidthScope {
+	case "", ConnectionBandwidth, SharedBandwidth:
+		return nil
+	}
+	return fmt.Errorf("bandwidthScope in rule '%s' is malformed, it must be '%s' or '%s'", r.Name, ConnectionBandwidth, SharedBandwidth)
+}
+
+// throttleFor returns the throttle of a rule for a connection, or the one shared by every connection
+func (p *Plan) throttleFor(rule *Rule, s *session) *throttle {
+	if rule.BandwidthScope == SharedBandwidth {
+		p.m.Lock()
+		defer p.m.Unlock()
+
+		if p.throttles == nil {
+			p.throttles = map[*Rule]*throttle{}
+		}
+		t, ok := p.throttles[rule]
+		if !ok {
+			t = newThrottle(rule.Bandwidth)
+			p.throttles[rule] = t
+		}
+		return t
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.throttles == nil {
+		s.throttles = map[*Rule]*throttle{}
+	}
+	t, ok := s.throttles[rule]
+	if !ok {
+		t = newThrottle(rule.Bandwidth)
+		s.throttles[rule] = t
+	}
+	return t
+}
@@ -0,0 +1,107 @@
+package redfi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleReserve(t *testing.T) {
+	th := newThrottle(1000)
+
+	// the link is booked back to back: 100B at 1000B/s take 100ms
+	expected := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond}
+	for i, n := range []int{100, 100, 300, 100} {
+		wait := th.reserve(n)
+		if wait < expected[i]-10*time.Millisecond || wait > expected[i] {
+			t.Fatal(fmt.Sprintf("Case failed:\n\treservation #%d:\n\texpected = %s\n\toutput   = %s", i, expected[i], wait))
+		}
+	}
+}
+
+func TestProxyBandwidth(t *testing.T) {
+	cases := []struct {
+		scope   string
+		clients int
+		// minimum time for every client to get its reply
+		expected time.Duration
+	}{
+		// 300B at 1000B/s per client
+		{scope: ConnectionBandwidth, clients: 2, expected: 200 * time.Millisecond},
+		// 600B at 1000B/s across clients
+		{scope: SharedBandwidth, clients: 2, expected: 500 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		redisAddr := "unix:" + filepath.Join(dir, "redis.sock")
+		proxyAddr := "unix:" + filepath.Join(dir, "redfi.sock")
+
+		redis := fakeRedis(t, redisAddr)
+		defer redis.Close()
+
+		p, err := New("", redisAddr, proxyAddr, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.plan.ResponseRules = []*Rule{{Name: "slow", AlwaysMatch: true, Bandwidth: 1000, BandwidthScope: c.scope}}
+
+		ln, err := listen(proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go p.serve(ln, redisAddr, MakeLogger(-1))
+
+		// fakeRedis answers with the last argument, so the reply is 297 + 3 bytes long
+		value := strings.Repeat("v", 297)
+		expected := "+" + value + "\r\n"
+
+		start := time.Now()
+		errs := make(chan error, c.clients)
+		wg := sync.WaitGroup{}
+		for i := 0; i < c.clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				network, address := splitAddr(proxyAddr)
+				conn, err := net.Dial(network, address)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer conn.Close()
+
+				_, err = conn.Write([]byte(fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(value), value)))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				reply, err := readMessage(bufio.NewReader(conn))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(reply.Raw) != expected {
+					errs <- fmt.Errorf("unexpected reply: %q", reply.Raw)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < c.expected {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected = at least %s\n\toutput   = %s", c.scope, c.expected, elapsed))
+		}
+	}
+}
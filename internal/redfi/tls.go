@@ -0,0 +1,123 @@
+package redfi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// a curve crypto/tls doesn't implement, which leaves no curve to agree on with any client
+const unsupportedCurve tls.CurveID = 0xfefe
+
+// TLS 1.2 cipher suites that need a curve, so that the handshake can't fall back to RSA key exchange
+var ecdheCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+// EnableTLS terminates TLS on every client listener.
+// When clientCAFile is given, clients must present a certificate signed by one of its CAs.
+func (p *Proxy) EnableTLS(certFile, keyFile, clientCAFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(clientCAFile) > 0 {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	p.tlsConfig = cfg
+	return nil
+}
+
+// EnableRedisTLS connects to Redis over TLS.
+// caFile replaces the system CAs when given, serverName overrides the SNI taken from the redis address,
+// and skipVerify disables certificate verification, which is only meant for tests.
+func (p *Proxy) EnableRedisTLS(caFile, serverName string, skipVerify bool) error {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if len(caFile) > 0 {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = pool
+	}
+
+	p.redisTLS = cfg
+	return nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// dial connects to a Redis node, over TLS if enabled
+func (p *Proxy) dial(addr string) (net.Conn, error) {
+	network, address := splitAddr(addr)
+	if p.redisTLS != nil {
+		return tls.Dial(network, address, p.redisTLS)
+	}
+	return net.Dial(network, address)
+}
+
+// handshake runs the TLS handshake with a client, applying the first matching TLS rule
+func (p *Proxy) handshake(conn net.Conn, info *ConnInfo, logger Logger) (net.Conn, error) {
+	cfg := p.tlsConfig
+
+	rule := p.plan.SelectRule("TLS", p.plan.Rules(TLSStream), info, redcon.RESP{}, logger)
+	if rule != nil {
+		if rule.Delay > 0 || rule.Latency != nil {
+			delay := p.plan.delayFor(rule)
+			logger(1, fmt.Sprintf("TLS :: Delaying handshake: rule = %s, delay = %s\n", rule.Name, delay))
+			time.Sleep(delay)
+		}
+
+		if rule.Drop {
+			logger(1, fmt.Sprintf("TLS :: Dropping connection before handshake: rule = %s\n", rule.Name))
+			return nil, fmt.Errorf("connection dropped by rule '%s'", rule.Name)
+		}
+
+		if rule.HandshakeFail {
+			logger(1, fmt.Sprintf("TLS :: Failing handshake: rule = %s\n", rule.Name))
+			cfg = cfg.Clone()
+			// no key exchange can be agreed on, so the client gets a handshake_failure alert
+			cfg.CurvePreferences = []tls.CurveID{unsupportedCurve}
+			cfg.CipherSuites = ecdheCipherSuites
+		}
+	}
+
+	tlsConn := tls.Server(conn, cfg)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
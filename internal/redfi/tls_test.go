@@ -0,0 +1,90 @@
+package redfi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "redfi"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHandshake(t *testing.T) {
+	cases := []struct {
+		name       string
+		rules      []*Rule
+		maxVersion uint16
+		// alert received by the client when the handshake fails
+		alert string
+	}{
+		{
+			name: "no rules",
+		},
+		{
+			name:  "delayed handshake",
+			rules: []*Rule{{Name: "delay", Delay: 10, AlwaysMatch: true}},
+		},
+		{
+			name:  "failed handshake",
+			rules: []*Rule{{Name: "fail", HandshakeFail: true, AlwaysMatch: true}},
+			alert: "handshake failure",
+		},
+		{
+			name:       "failed TLS 1.2 handshake",
+			rules:      []*Rule{{Name: "fail", HandshakeFail: true, AlwaysMatch: true}},
+			maxVersion: tls.VersionTLS12,
+			alert:      "handshake failure",
+		},
+	}
+
+	for _, c := range cases {
+		p := &Proxy{
+			plan:      &Plan{TLSRules: c.rules},
+			tlsConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+		}
+
+		clientConn, serverConn := net.Pipe()
+		client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, MaxVersion: c.maxVersion})
+		clientErr := make(chan error, 1)
+		go func() {
+			clientErr <- client.Handshake()
+			client.Close()
+		}()
+
+		_, err := p.handshake(serverConn, &ConnInfo{ClientAddr: "pipe"}, MakeLogger(-1))
+		serverConn.Close()
+		if (err == nil) != (len(c.alert) == 0) {
+			t.Fatalf("Case failed:\n\t%s:\n\tserver handshake error = %v", c.name, err)
+		}
+		err = <-clientErr
+		if (err == nil) != (len(c.alert) == 0) || (err != nil && !strings.Contains(err.Error(), "remote error: tls: "+c.alert)) {
+			t.Fatal(fmt.Sprintf("Case failed:\n\t%s:\n\texpected alert = %s\n\tclient error   = %v", c.name, c.alert, err))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package redfi
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how often the plan file is checked for changes
+var planPollInterval = time.Second
+
+// Replace swaps in the rules of the given plan.
+// Live connections keep running and pick up the new rules on their next message.
+func (p *Plan) Replace(next *Plan) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, kind := range ruleKinds {
+		rules, _ := p.rulesFor(kind)
+		nextRules, _ := next.rulesFor(kind)
+		*rules = *nextRules
+	}
+	p.Seed = next.Seed
+	p.rand = next.rand
+	// the scenario starts over from its first phase
+	p.Phases = next.Phases
+	p.common = next.common
+	p.phase = next.phase
+	p.phaseStart = next.phaseStart
+	p.phaseRule = next.phaseRule
+	p.phaseHits = next.phaseHits
+	p.signaled = next.signaled
+	// scheduled rules keep their timing across reloads, unless what they're timed from changed
+	if p.epoch.IsZero() || p.scheduleFrom() != next.scheduleFrom() {
+		p.epoch = next.epoch
+	}
+	p.ScheduleFrom = next.ScheduleFrom
+}
+
+// ReloadPlan parses the plan file again and swaps in its rules.
+// The current rules are kept if the file fails to parse.
+func (p *Proxy) ReloadPlan(logger Logger) error {
+	next, err := Parse(p.planPath)
+	if err != nil {
+		logger(0, fmt.Sprintf("Failed to reload plan file, keeping the current rules: %s\n", err))
+		return err
+	}
+
+	p.plan.Replace(next)
+	logger(0, fmt.Sprintf("Reloaded %d rules from plan file\n", next.RuleCount()))
+	return nil
+}
+
+// WatchPlan reloads the plan whenever the plan file changes or the process receives SIGHUP.
+// It blocks forever, so it's meant to be run in its own goroutine.
+func (p *Proxy) WatchPlan(logger Logger) {
+	if len(p.planPath) == 0 {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(planPollInterval)
+	defer ticker.Stop()
+
+	last, _ := os.Stat(p.planPath)
+	for {
+		select {
+		case <-hup:
+			logger(0, "Received SIGHUP, reloading plan file\n")
+			last, _ = os.Stat(p.planPath)
+			p.ReloadPlan(logger)
+
+		case <-ticker.C:
+			info, err := os.Stat(p.planPath)
+			if err != nil {
+				// editors often replace the file, wait for the new one to show up
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+
+			last = info
+			logger(0, "Plan file changed, reloading\n")
+			p.ReloadPlan(logger)
+		}
+	}
+}